@@ -0,0 +1,295 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Limits protecting against archives filling the disk
+var (
+	maxFileSize  int64 = 1 << 30 // Size of a single file
+	maxTotalSize int64 = 4 << 30 // Size of all files of an archive
+)
+
+// Extract extracts a .tar, .tar.gz/.tgz, .tar.bz2, .tar.xz or .zip archive to
+// targetFolder, detecting the format from the content. Entries are streamed to disk
+// with their mode and modification time. Entries that would be extracted outside of
+// targetFolder, links pointing outside of it, devices and oversized files are refused.
+func Extract(r io.Reader, targetFolder string) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(262)
+
+	e, err := newExtractor(targetFolder)
+	if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")) {
+		err = e.extractZip(r, br)
+	} else {
+		var tr io.Reader
+		if tr, err = decompress(br, magic); err == nil {
+			err = e.extractTar(tr)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return e.finish()
+}
+
+// decompress returns the tar stream of a compressed tar archive
+func decompress(r io.Reader, magic []byte) (io.Reader, error) {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(r)
+
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(r), nil
+
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return xz.NewReader(r)
+
+	case len(magic) == 262 && bytes.HasPrefix(magic[257:], []byte("ustar")):
+		return r, nil
+	}
+
+	return nil, fmt.Errorf("unsupported archive format")
+}
+
+// extractor creates the entries of an archive in a target folder
+type extractor struct {
+	targetFolder string
+	totalSize    int64
+	dirs         map[string]time.Time // Modification times are set once all files are extracted
+}
+
+func newExtractor(targetFolder string) (*extractor, error) {
+	targetFolder, err := filepath.Abs(targetFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(targetFolder, 0755); err != nil {
+		return nil, err
+	}
+
+	return &extractor{targetFolder: targetFolder, dirs: make(map[string]time.Time)}, nil
+}
+
+// entryName returns the name of an entry relative to the target folder. The files
+// in the archive are all in a parent folder, we want to extract all files directly to folder
+func entryName(name string) string {
+	namePath := strings.Split(name, "/")
+	if len(namePath) < 2 {
+		return "/"
+	}
+
+	return strings.Join(namePath[1:], "/")
+}
+
+// within returns true if file is the folder, or is inside it
+func within(folder string, file string) bool {
+	rel, err := filepath.Rel(folder, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// linkWithin returns true if the symlink link, pointing to linkname, resolves inside
+// folder. Parent references are only allowed at the start of linkname: lexically,
+// x/s/.. is x, but if s is itself a symlink, it really is the parent of the target of s.
+func linkWithin(folder string, link string, linkname string) bool {
+	if path.IsAbs(linkname) {
+		return false
+	}
+
+	leading := true
+	for _, component := range strings.Split(linkname, "/") {
+		switch component {
+		case "..":
+			if !leading {
+				return false
+			}
+		case ".", "":
+		default:
+			leading = false
+		}
+	}
+
+	return within(folder, path.Join(path.Dir(link), linkname))
+}
+
+// checkParents returns an error if any folder between targetFolder and file is a
+// symlink, as files would be written wherever it points to
+func checkParents(targetFolder string, file string) error {
+	rel, _ := filepath.Rel(targetFolder, path.Dir(file))
+	if rel == "." {
+		return nil
+	}
+
+	parent := targetFolder
+	for _, component := range strings.Split(rel, "/") {
+		parent = path.Join(parent, component)
+		if fi, err := os.Lstat(parent); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is inside the symlink %s", file, parent)
+		}
+	}
+
+	return nil
+}
+
+// target returns the file an entry named name is extracted to, refusing any
+// file outside of the target folder
+func (e *extractor) target(name string) (string, error) {
+	file := path.Join(e.targetFolder, entryName(name))
+	if !within(e.targetFolder, file) {
+		return "", fmt.Errorf("%s would be extracted outside of %s", name, e.targetFolder)
+	}
+
+	if err := checkParents(e.targetFolder, file); err != nil {
+		return "", err
+	}
+
+	return file, nil
+}
+
+func (e *extractor) dir(name string, mode os.FileMode, mtime time.Time) error {
+	targetFilename, err := e.target(name)
+	if err != nil {
+		return err
+	}
+
+	// Folders must stay writable for their files to be extracted
+	if err = os.MkdirAll(targetFilename, 0755); err != nil {
+		return fmt.Errorf("failed creating %s: %v", targetFilename, err)
+	}
+	if err = os.Chmod(targetFilename, mode.Perm()|0700); err != nil {
+		return fmt.Errorf("failed creating %s: %v", targetFilename, err)
+	}
+
+	e.dirs[targetFilename] = mtime
+
+	return nil
+}
+
+// file writes the content of an entry, replacing any file or symlink already extracted there
+func (e *extractor) file(name string, r io.Reader, size int64, mode os.FileMode, mtime time.Time) error {
+	targetFilename, err := e.target(name)
+	if err != nil {
+		return err
+	}
+
+	e.totalSize += size
+	if size > maxFileSize || e.totalSize > maxTotalSize {
+		return fmt.Errorf("failed extracting %s: archive too large", name)
+	}
+
+	if err = os.MkdirAll(path.Dir(targetFilename), 0755); err != nil {
+		return fmt.Errorf("failed creating %s: %v", targetFilename, err)
+	}
+
+	if fi, err := os.Lstat(targetFilename); err == nil && !fi.IsDir() {
+		os.Remove(targetFilename)
+	}
+
+	f, err := os.OpenFile(targetFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("failed creating %s: %v", targetFilename, err)
+	}
+
+	// Entries larger than announced are truncated
+	_, err = io.Copy(f, io.LimitReader(r, size))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed creating %s: %v", targetFilename, err)
+	}
+
+	// The mode is set again, as the umask applies when creating the file
+	if err = os.Chmod(targetFilename, mode.Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(targetFilename, mtime, mtime)
+}
+
+func (e *extractor) symlink(name string, linkname string) error {
+	targetFilename, err := e.target(name)
+	if err != nil {
+		return err
+	}
+
+	if !linkWithin(e.targetFolder, targetFilename, linkname) {
+		return fmt.Errorf("symlink %s to %s points outside of %s", name, linkname, e.targetFolder)
+	}
+
+	if err := os.Symlink(linkname, targetFilename); err != nil {
+		return fmt.Errorf("failed creating symlink %s to %s : %v", targetFilename, linkname, err)
+	}
+
+	return nil
+}
+
+// hardlink links name to linkname, another entry of the archive
+func (e *extractor) hardlink(name string, linkname string) error {
+	targetFilename, err := e.target(name)
+	if err != nil {
+		return err
+	}
+
+	linkTarget, err := e.target(linkname)
+	if err != nil {
+		return fmt.Errorf("hardlink %s to %s: %v", name, linkname, err)
+	}
+
+	if fi, err := os.Lstat(linkTarget); err != nil || !fi.Mode().IsRegular() {
+		return fmt.Errorf("hardlink %s to %s: not a file of the archive", name, linkname)
+	}
+
+	if err := os.Link(linkTarget, targetFilename); err != nil {
+		return fmt.Errorf("failed creating hardlink %s to %s : %v", targetFilename, linkname, err)
+	}
+
+	return nil
+}
+
+// finish sets the modification times of folders, which change whenever a file is created
+func (e *extractor) finish() error {
+	for dir, mtime := range e.dirs {
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// spool copies r to a temporary file, for formats that need random access
+func spool(r io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile("", "r10k-archive")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
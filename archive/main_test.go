@@ -0,0 +1,252 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type entry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func archive(entries []entry) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	for _, e := range entries {
+		tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body))})
+		tw.Write([]byte(e.body))
+	}
+
+	tw.Close()
+	gzw.Close()
+
+	return buf.Bytes()
+}
+
+func TestMain(m *testing.M) {
+	os.RemoveAll("tmp")
+	res := m.Run()
+	os.RemoveAll("tmp")
+	os.Exit(res)
+}
+
+func TestExtract(t *testing.T) {
+	a := archive([]entry{
+		{name: "module-1.0/", typeflag: tar.TypeDir},
+		{name: "module-1.0/manifests/init.pp", typeflag: tar.TypeReg, body: "class module {}"},
+		{name: "module-1.0/files/", typeflag: tar.TypeDir},
+		{name: "module-1.0/files/current", typeflag: tar.TypeSymlink, linkname: "../manifests/init.pp"},
+		{name: "module-1.0/files/copy.pp", typeflag: tar.TypeLink, linkname: "module-1.0/manifests/init.pp"},
+		{name: "module-1.0/lib/", typeflag: tar.TypeSymlink, linkname: "files"},
+	})
+
+	if err := Extract(bytes.NewReader(a), "tmp/valid"); err != nil {
+		t.Fatalf("failed extracting valid archive: %v", err)
+	}
+
+	for _, file := range []string{"manifests/init.pp", "files/current", "files/copy.pp"} {
+		if content, err := ioutil.ReadFile(path.Join("tmp/valid", file)); err != nil || string(content) != "class module {}" {
+			t.Errorf("unexpected content for %s: %s, %v", file, content, err)
+		}
+	}
+}
+
+func TestExtractFormats(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, format := range []string{"tar", "tgz", "tar.bz2", "tar.xz", "zip"} {
+		to := "tmp/formats/" + format
+		f, err := os.Open("test-fixtures/module-1.0." + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Extract(f, to)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: failed extracting archive: %v", format, err)
+			continue
+		}
+
+		for _, file := range []string{"manifests/init.pp", "files/current"} {
+			if content, err := ioutil.ReadFile(path.Join(to, file)); err != nil || string(content) != "class module {}\n" {
+				t.Errorf("%s: unexpected content for %s: %s, %v", format, file, content, err)
+			}
+		}
+
+		fi, err := os.Stat(path.Join(to, "files/script.sh"))
+		if err != nil || fi.Mode().Perm() != 0755 {
+			t.Errorf("%s: files/script.sh should be executable: %v", format, err)
+		}
+
+		for _, file := range []string{"manifests/init.pp", "files/script.sh", "manifests"} {
+			if fi, err := os.Stat(path.Join(to, file)); err != nil || !fi.ModTime().Equal(mtime) {
+				t.Errorf("%s: %s should be modified at %s: %v", format, file, mtime, err)
+			}
+		}
+	}
+}
+
+// Zip archives are read from a temporary file when not given a file
+func TestExtractZipStream(t *testing.T) {
+	content, _ := ioutil.ReadFile("test-fixtures/module-1.0.zip")
+	if err := Extract(bytes.NewReader(content), "tmp/zip-stream"); err != nil {
+		t.Fatalf("failed extracting archive: %v", err)
+	}
+
+	if _, err := os.Stat("tmp/zip-stream/manifests/init.pp"); err != nil {
+		t.Errorf("failed extracting manifests/init.pp: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, format := range []string{"tar", "tgz", "tar.bz2", "tar.xz", "zip"} {
+		content, err := ioutil.ReadFile("test-fixtures/module-1.0." + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = Verify(bytes.NewReader(content)); err != nil {
+			t.Errorf("%s: failed verifying archive: %v", format, err)
+		}
+
+		// Tar archives end with padding, the truncated archive must end within an entry
+		truncated := content[:len(content)/2]
+		if format == "tar" {
+			truncated = content[:1100]
+		}
+		if err = Verify(bytes.NewReader(truncated)); err == nil {
+			t.Errorf("%s: verifying a truncated archive should fail", format)
+		}
+
+		// Uncompressed tar archives have no checksum of their content
+		if format == "tar" {
+			continue
+		}
+
+		corrupted := append([]byte{}, content...)
+		for i := len(corrupted) / 2; i < len(corrupted)/2+8; i++ {
+			corrupted[i] ^= 0xff
+		}
+		if err = Verify(bytes.NewReader(corrupted)); err == nil {
+			t.Errorf("%s: verifying a corrupted archive should fail", format)
+		}
+	}
+}
+
+func TestExtractLongNames(t *testing.T) {
+	name := strings.Repeat("long-folder-name/", 20) + "init.pp"
+	a := archive([]entry{
+		{name: "module-1.0/" + name, typeflag: tar.TypeReg, body: "class module {}"},
+	})
+
+	if err := Extract(bytes.NewReader(a), "tmp/long-names"); err != nil {
+		t.Fatalf("failed extracting archive: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join("tmp/long-names", name)); err != nil {
+		t.Errorf("failed extracting %s: %v", name, err)
+	}
+}
+
+func TestExtractUnsupportedFormat(t *testing.T) {
+	if err := Extract(strings.NewReader("not an archive"), "tmp/unsupported"); err == nil {
+		t.Error("extracting an unknown format should fail")
+	}
+}
+
+// Crafted archives, that must be refused without creating any file outside of the target folder
+func TestExtractHostileArchives(t *testing.T) {
+	defer func(fileSize, totalSize int64) { maxFileSize, maxTotalSize = fileSize, totalSize }(maxFileSize, maxTotalSize)
+	maxFileSize, maxTotalSize = 16, 24
+
+	testCases := map[string][]entry{
+		"path traversal": {
+			{name: "module-1.0/../../evil", typeflag: tar.TypeReg, body: "evil"},
+		},
+		"path traversal to the parent folder": {
+			{name: "module-1.0/../evil", typeflag: tar.TypeReg, body: "evil"},
+		},
+		"symlink outside": {
+			{name: "module-1.0/evil", typeflag: tar.TypeSymlink, linkname: "../evil"},
+		},
+		"absolute symlink": {
+			{name: "module-1.0/evil", typeflag: tar.TypeSymlink, linkname: "/etc"},
+		},
+		"symlink through symlink": {
+			{name: "module-1.0/sub/", typeflag: tar.TypeDir},
+			{name: "module-1.0/sub/up", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "module-1.0/evil", typeflag: tar.TypeSymlink, linkname: "sub/up/.."},
+		},
+		"file through symlink": {
+			{name: "module-1.0/sub/", typeflag: tar.TypeDir},
+			{name: "module-1.0/link", typeflag: tar.TypeSymlink, linkname: "sub"},
+			{name: "module-1.0/link/evil", typeflag: tar.TypeReg, body: "evil"},
+		},
+		"hardlink outside": {
+			{name: "module-1.0/evil", typeflag: tar.TypeLink, linkname: "module-1.0/../../evil"},
+		},
+		"hardlink to a missing file": {
+			{name: "module-1.0/evil", typeflag: tar.TypeLink, linkname: "/etc/passwd"},
+		},
+		"hardlink to a symlink": {
+			{name: "module-1.0/link", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "module-1.0/evil", typeflag: tar.TypeLink, linkname: "module-1.0/link"},
+		},
+		"character device": {
+			{name: "module-1.0/evil", typeflag: tar.TypeChar},
+		},
+		"block device": {
+			{name: "module-1.0/evil", typeflag: tar.TypeBlock},
+		},
+		"fifo": {
+			{name: "module-1.0/evil", typeflag: tar.TypeFifo},
+		},
+		"oversized file": {
+			{name: "module-1.0/big", typeflag: tar.TypeReg, body: "0123456789abcdefg"},
+		},
+		"oversized archive": {
+			{name: "module-1.0/a", typeflag: tar.TypeReg, body: "0123456789"},
+			{name: "module-1.0/b", typeflag: tar.TypeReg, body: "0123456789"},
+			{name: "module-1.0/c", typeflag: tar.TypeReg, body: "0123456789"},
+		},
+	}
+
+	for name, entries := range testCases {
+		folder := path.Join("tmp", name)
+		if err := Extract(bytes.NewReader(archive(entries)), path.Join(folder, "target")); err == nil {
+			t.Errorf("%s: extracting archive should fail", name)
+		}
+
+		// Nothing may be created next to the target folder
+		files, _ := ioutil.ReadDir(folder)
+		if len(files) != 1 || files[0].Name() != "target" {
+			t.Errorf("%s: files were created outside of the target folder", name)
+		}
+
+		// Links extracted before the error must not point outside either
+		target, _ := filepath.Abs(path.Join(folder, "target"))
+		target, _ = filepath.EvalSymlinks(target)
+		filepath.Walk(target, func(file string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				if resolved, err := filepath.EvalSymlinks(file); err == nil && !within(target, resolved) {
+					t.Errorf("%s: %s points outside of the target folder", name, file)
+				}
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+)
+
+// extractTar extracts an uncompressed tar stream. PAX and GNU long names are
+// handled by the tar reader.
+func (e *extractor) extractTar(r io.Reader) error {
+	tarReader := tar.NewReader(r)
+
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fi := header.FileInfo()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.dir(header.Name, fi.Mode(), header.ModTime)
+
+		case tar.TypeReg:
+			err = e.file(header.Name, tarReader, header.Size, fi.Mode(), header.ModTime)
+
+		case tar.TypeSymlink:
+			err = e.symlink(header.Name, header.Linkname)
+
+		case tar.TypeLink:
+			err = e.hardlink(header.Name, header.Linkname)
+
+		case tar.TypeXGlobalHeader:
+			continue
+
+		default:
+			err = fmt.Errorf("failed extracting %s: unsupported file type %q", header.Name, header.Typeflag)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Verify reads the whole archive without extracting it, and returns an error if it
+// is truncated or corrupted. Compressed streams and zip entries are checked against
+// their checksums.
+func Verify(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(262)
+
+	if bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")) {
+		return verifyZip(r, br)
+	}
+
+	tr, err := decompress(br, magic)
+	if err != nil {
+		return err
+	}
+
+	tarReader := tar.NewReader(tr)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(ioutil.Discard, tarReader); err != nil {
+			return fmt.Errorf("failed reading %s: %v", header.Name, err)
+		}
+	}
+
+	// Checksums of compressed streams are only verified at their end
+	_, err = io.Copy(ioutil.Discard, tr)
+	return err
+}
+
+func verifyZip(r io.Reader, buffered io.Reader) error {
+	f, ok := r.(*os.File)
+	if !ok {
+		var err error
+		if f, err = spool(buffered); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("failed reading %s: %v", zf.Name, err)
+		}
+
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed reading %s: %v", zf.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// extractZip extracts a zip archive, which can only be read with random access:
+// files are read from their start, other readers are first copied to a temporary file
+func (e *extractor) extractZip(r io.Reader, buffered io.Reader) error {
+	f, ok := r.(*os.File)
+	if !ok {
+		var err error
+		if f, err = spool(buffered); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		if err = e.extractZipEntry(zf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *extractor) extractZipEntry(zf *zip.File) error {
+	mode := zf.Mode()
+
+	switch {
+	case mode.IsDir():
+		return e.dir(zf.Name, mode, zf.Modified)
+
+	case mode.IsRegular():
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		return e.file(zf.Name, r, int64(zf.UncompressedSize64), mode, zf.Modified)
+
+	case mode&os.ModeSymlink != 0:
+		// The target of a symlink is stored as its content
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		linkname, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+		if err != nil {
+			return err
+		}
+
+		return e.symlink(zf.Name, strings.TrimSpace(string(linkname)))
+	}
+
+	return fmt.Errorf("failed extracting %s: unsupported file type %s", zf.Name, mode.Type())
+}
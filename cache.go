@@ -2,14 +2,22 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
+	"path"
+	"sort"
 	"sync"
+
+	"github.com/yannh/r10k-go/git"
+	"github.com/yannh/r10k-go/store"
 )
 
 type cache struct {
 	sync.Mutex
-	folder string
-	Locks  map[interface{}]*sync.Mutex
+	folder  string
+	used    map[string]bool // Entries used during this run
+	missing []string        // Modules that could not be deployed offline, and what they miss
 }
 
 func newCache(cacheFolder string) (*cache, error) {
@@ -18,24 +26,61 @@ func newCache(cacheFolder string) (*cache, error) {
 			return &cache{}, fmt.Errorf("Failed creating cache folder %s: %s", cacheFolder, err.Error())
 		}
 	}
-	return &cache{folder: cacheFolder, Locks: make(map[interface{}]*sync.Mutex)}, nil
+	return &cache{folder: cacheFolder, used: make(map[string]bool)}, nil
 }
 
-func (cache *cache) lockModule(o interface{}) { // FIXME that was a bad improvement, we want to lock on target folder name
-	cache.Lock()
-	if _, ok := cache.Locks[o]; !ok {
-		cache.Locks[o] = new(sync.Mutex)
+// pruneWorktrees unregisters the worktrees of all cached repositories
+// whose folder has been deleted
+func (cache *cache) pruneWorktrees() {
+	files, err := ioutil.ReadDir(cache.folder)
+	if err != nil {
+		log.Printf("failed pruning worktrees: %v", err)
+		return
 	}
-	l := (*cache).Locks[o]
-	// We need to unlock cache before waiting for the
-	// module lock, otherwise UnlockModule can not unlock it
-	cache.Unlock()
 
-	l.Lock()
+	for _, f := range files {
+		repository := path.Join(cache.folder, f.Name())
+		if _, err := os.Stat(path.Join(repository, ".git", "worktrees")); err != nil {
+			continue
+		}
+
+		if err := git.WorktreePrune(repository); err != nil {
+			log.Printf("failed pruning worktrees of %s: %v", repository, err)
+		}
+	}
 }
 
-func (cache *cache) unlockModule(o interface{}) {
+// pruneStore removes the releases of the store that are not deployed anymore
+func (cache *cache) pruneStore() {
+	removed, err := store.GC(cache.folder)
+	if err != nil {
+		log.Printf("failed pruning the store: %v", err)
+	}
+
+	for _, key := range removed {
+		log.Printf("Removed %s from the store", key)
+	}
+}
+
+// miss records a module that could not be deployed offline
+func (cache *cache) miss(module string, err error) {
 	cache.Lock()
-	(*cache).Locks[o].Unlock()
+	cache.missing = append(cache.missing, module+" - "+err.Error())
 	cache.Unlock()
 }
+
+// reportMissing lists the modules that could not be deployed offline
+func (cache *cache) reportMissing() {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if len(cache.missing) == 0 {
+		return
+	}
+
+	sort.Strings(cache.missing)
+	log.Printf("%d modules could not be deployed offline:", len(cache.missing))
+	for _, m := range cache.missing {
+		log.Printf("  %s", m)
+	}
+}
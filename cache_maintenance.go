@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yannh/r10k-go/git"
+	"github.com/yannh/r10k-go/lock"
+	"github.com/yannh/r10k-go/puppetfileparser"
+	"github.com/yannh/r10k-go/puppetmodule"
+	"github.com/yannh/r10k-go/puppetsource"
+	"github.com/yannh/r10k-go/sidecar"
+	"github.com/yannh/r10k-go/store"
+)
+
+// Folders of the cache that are not cache entries
+var reservedCacheFolders = map[string]bool{
+	"environments": true, // States of the deployed environments
+	"store":        true, // Pruned separately, see pruneStore
+}
+
+// cacheEntry is a folder of the cache: a git repository, or the archives of a module
+type cacheEntry struct {
+	name        string
+	kind        string // git or archive
+	description string // Source of the entry, or remote of git repositories and archives if unknown
+	size        int64
+	lastUsed    time.Time
+	fetchedAt   time.Time // Zero if unknown
+	checksums   map[string]string
+	usedBy      []string // Environments and modules using the entry
+}
+
+// touch marks the entry as used, entries used recently are pruned last
+func (cache *cache) touch(entry string) {
+	now := time.Now()
+	os.Chtimes(path.Join(cache.folder, entry), now, now)
+
+	cache.Lock()
+	cache.used[entry] = true
+	cache.Unlock()
+}
+
+// usedEntries returns the cache entries used by the modules of all deployed environments,
+// by the sources, and during this run, with what uses them
+func (cache *cache) usedEntries(sources []puppetsource.Source) map[string][]string {
+	used := make(map[string][]string)
+
+	cache.Lock()
+	for entry := range cache.used {
+		used[entry] = append(used[entry], "this deploy")
+	}
+	cache.Unlock()
+
+	for _, s := range sources {
+		used[s.Name()] = append(used[s.Name()], "source "+s.Name())
+
+		if _, err := os.Stat(s.Basedir()); err != nil {
+			continue
+		}
+
+		for _, env := range DeployedEnvironments(s) {
+			pf := newPuppetFile(path.Join(s.Basedir(), env.branch, "Puppetfile"), env)
+			if pf == nil {
+				continue
+			}
+
+			modules, opts, err := puppetfileparser.Parse(bufio.NewScanner(pf))
+			pf.Close()
+			if err != nil {
+				log.Printf("failed parsing the Puppetfile of environment %s: %v", env.branch, err)
+				continue
+			}
+			pf.forge = opts["forge"]
+
+			for _, module := range modules {
+				if m, ok := pf.toTypedModule(module).(puppetmodule.Cached); ok {
+					used[m.CacheEntry()] = append(used[m.CacheEntry()], env.branch+"/"+module["name"])
+				}
+			}
+		}
+	}
+
+	return used
+}
+
+// entries returns all entries of the cache, least recently used first
+func (cache *cache) entries(used map[string][]string) ([]cacheEntry, error) {
+	files, err := ioutil.ReadDir(cache.folder)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]cacheEntry, 0)
+	for _, f := range files {
+		if !f.IsDir() || reservedCacheFolders[f.Name()] {
+			continue
+		}
+
+		folder := path.Join(cache.folder, f.Name())
+		entry := cacheEntry{name: f.Name(), kind: "archive", size: folderSize(folder), lastUsed: f.ModTime(), usedBy: used[f.Name()]}
+
+		if _, err := os.Stat(path.Join(folder, ".git")); err == nil {
+			entry.kind = "git"
+			entry.description, _ = git.RemoteURL(folder)
+
+			// Repositories with worktrees can not be removed without breaking them
+			if worktrees, err := git.Worktrees(folder); err == nil {
+				for _, worktree := range worktrees {
+					if _, err := os.Stat(worktree); err == nil {
+						entry.usedBy = append(entry.usedBy, worktree)
+					}
+				}
+			}
+		} else {
+			archives, _ := ioutil.ReadDir(folder)
+			names := make([]string, 0)
+			for _, a := range archives {
+				names = append(names, a.Name())
+			}
+			entry.description = strings.Join(names, ", ")
+		}
+
+		// Entries cached by previous versions of r10k-go are not described
+		if e, err := sidecar.Read(cache.folder, f.Name()); err == nil {
+			entry.description = e.Source
+			entry.fetchedAt = e.FetchedAt
+			entry.checksums = e.Checksums
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed.Before(entries[j].lastUsed) })
+
+	return entries, nil
+}
+
+// size returns the size of the cache, including the store
+func (cache *cache) size() int64 {
+	return folderSize(cache.folder)
+}
+
+func folderSize(folder string) int64 {
+	var size int64
+	filepath.Walk(folder, func(file string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+// verify checks every entry of the cache, and returns the entries that are corrupted
+func (cache *cache) verify(entries []cacheEntry) map[string]error {
+	corrupted := make(map[string]error)
+
+	for _, entry := range entries {
+		folder := path.Join(cache.folder, entry.name)
+
+		if entry.kind == "git" {
+			if err := git.Fsck(folder); err != nil {
+				corrupted[entry.name] = err
+			}
+			continue
+		}
+
+		archives, _ := ioutil.ReadDir(folder)
+		for _, a := range archives {
+			// Downloads in progress
+			if !a.Mode().IsRegular() || strings.HasSuffix(a.Name(), ".part") {
+				continue
+			}
+
+			if err := puppetmodule.VerifyArchive(path.Join(folder, a.Name()), entry.checksums[a.Name()]); err != nil {
+				corrupted[entry.name] = fmt.Errorf("%s: %v", a.Name(), err)
+				break
+			}
+		}
+	}
+
+	return corrupted
+}
+
+// prune removes the entries of the cache that are not used, least recently used first.
+// If olderThan is set, only entries not used for that long are removed. If maxSize is
+// set, entries are only removed until the cache is smaller.
+func (cache *cache) prune(used map[string][]string, olderThan time.Duration, maxSize int64) ([]cacheEntry, error) {
+	cache.pruneWorktrees()
+	cache.pruneStore()
+
+	entries, err := cache.entries(used)
+	if err != nil {
+		return nil, err
+	}
+
+	size := cache.size()
+	removed := make([]cacheEntry, 0)
+	for _, entry := range entries {
+		if maxSize > 0 && size <= maxSize {
+			break
+		}
+
+		if len(entry.usedBy) > 0 || (olderThan > 0 && time.Since(entry.lastUsed) < olderThan) {
+			continue
+		}
+
+		// Entries being updated by a running deploy are in use
+		l, err := lock.TryAcquire(path.Join(cache.folder, entry.name) + ".lock")
+		if err != nil {
+			continue
+		}
+
+		err = os.RemoveAll(path.Join(cache.folder, entry.name))
+		if err == nil {
+			os.Remove(path.Join(cache.folder, entry.name) + ".json")
+		}
+		l.Release()
+		if err != nil {
+			return removed, err
+		}
+		size -= entry.size
+		removed = append(removed, entry)
+	}
+
+	if maxSize > 0 && size > maxSize {
+		log.Printf("cache %s is %s, more than %s, but all remaining entries are used", cache.folder, formatSize(size), formatSize(maxSize))
+	}
+
+	return removed, nil
+}
+
+// limitSize prunes the cache once it grows larger than maxSize
+func (cache *cache) limitSize(sources []puppetsource.Source, maxSize int64) {
+	if maxSize == 0 || cache.size() <= maxSize {
+		return
+	}
+
+	removed, err := cache.prune(cache.usedEntries(sources), 0, maxSize)
+	if err != nil {
+		log.Printf("failed pruning the cache: %v", err)
+	}
+
+	for _, entry := range removed {
+		log.Printf("Removed %s (%s) from the cache", entry.name, formatSize(entry.size))
+	}
+}
+
+// listCache prints all entries of the cache, least recently used first
+func listCache(cache *cache, sources []puppetsource.Source) int {
+	entries, err := cache.entries(cache.usedEntries(sources))
+	if err != nil {
+		log.Printf("failed listing the cache: %v", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTRY\tTYPE\tSIZE\tLAST USED\tFETCHED\tSOURCE\tUSED BY")
+	for _, entry := range entries {
+		usedBy := "-"
+		if len(entry.usedBy) > 0 {
+			usedBy = strings.Join(entry.usedBy, ", ")
+		}
+
+		fetchedAt := "-"
+		if !entry.fetchedAt.IsZero() {
+			fetchedAt = entry.fetchedAt.Local().Format("2006-01-02 15:04")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.name, entry.kind, formatSize(entry.size), entry.lastUsed.Format("2006-01-02 15:04"), fetchedAt, entry.description, usedBy)
+	}
+	w.Flush()
+
+	fmt.Printf("Total: %s, including %s in the store\n", formatSize(cache.size()), formatSize(folderSize(store.Folder(cache.folder))))
+
+	return 0
+}
+
+// verifyCache checks all entries of the cache, and returns 1 if any is corrupted
+func verifyCache(cache *cache) int {
+	entries, err := cache.entries(nil)
+	if err != nil {
+		log.Printf("failed listing the cache: %v", err)
+		return 1
+	}
+
+	corrupted := cache.verify(entries)
+	for _, entry := range entries {
+		if err, ok := corrupted[entry.name]; ok {
+			fmt.Printf("%s: corrupted, %v\n", entry.name, err)
+		} else {
+			fmt.Printf("%s: OK\n", entry.name)
+		}
+	}
+
+	if len(corrupted) > 0 {
+		log.Printf("%d corrupted entries, they can be removed and will be downloaded again", len(corrupted))
+		return 1
+	}
+
+	return 0
+}
+
+// pruneCache removes the entries of the cache not used by any deployed environment
+func pruneCache(cache *cache, sources []puppetsource.Source, olderThan time.Duration, maxSize int64) int {
+	removed, err := cache.prune(cache.usedEntries(sources), olderThan, maxSize)
+	for _, entry := range removed {
+		fmt.Printf("Removed %s (%s)\n", entry.name, formatSize(entry.size))
+	}
+
+	if err != nil {
+		log.Printf("failed pruning the cache: %v", err)
+		return 1
+	}
+
+	return 0
+}
+
+// parseSize parses sizes such as 512M or 10G
+func parseSize(s string) (int64, error) {
+	units := map[string]int64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	unit := strings.TrimLeft(s, "0123456789.")
+	multiplier, ok := units[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %s, expected eg 512M or 10G", s)
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSuffix(s, unit), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s, expected eg 512M or 10G", s)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+func formatSize(size int64) string {
+	for i, unit := range []string{"T", "G", "M", "K"} {
+		if multiplier := int64(1) << uint(10*(4-i)); size >= multiplier {
+			return strconv.FormatFloat(float64(size)/float64(multiplier), 'f', 1, 64) + unit
+		}
+	}
+
+	return strconv.FormatInt(size, 10) + "B"
+}
+
+// parseAge parses durations such as 12h, or a number of days such as 30d
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid duration %s, expected eg 12h or 30d", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %s, expected eg 12h or 30d", s)
+	}
+
+	return d, nil
+}
@@ -9,19 +9,27 @@ func cli() map[string]interface{} {
 	usage := `r10k-go
 
 Usage:
-  r10k-go puppetfile install [--moduledir=<PATH>] [--no-deps] [--puppetfile=<PUPPETFILE>] [--workers=<n>]
+  r10k-go puppetfile install [--moduledir=<PATH>] [--no-deps] [--puppetfile=<PUPPETFILE>] [--workers=<n>] [--report=<FILE>] [--offline]
   r10k-go puppetfile check [--puppetfile=<PUPPETFILE>]
-  r10k-go deploy environment <env>... [--workers=<n>]
-  r10k-go deploy module <module>... [--environment=<env>] [--workers=<n>]
+  r10k-go deploy environment <env>... [--workers=<n>] [--report=<FILE>] [--force] [--offline]
+  r10k-go deploy module <module>... [--environment=<env>] [--workers=<n>] [--report=<FILE>] [--offline]
+  r10k-go cache list
+  r10k-go cache verify
+  r10k-go cache prune [--older-than=<duration>] [--max-size=<size>]
   r10k-go version
   r10k-go -h | --help
   r10k-go --version
 
 Options:
   -h --help                   Show this screen.
+  --force                     Deploy environments even if they did not change
+  --max-size=<size>           Only remove entries until the cache is smaller, eg 10G
   --modulesdir=<PATH>        Path to the modules folder
   --no-deps                   Skip downloading modules dependencies
+  --offline                   Deploy from the cache only, without any network access
+  --older-than=<duration>     Only remove entries unused for longer, eg 12h or 30d
   --puppetFile=<PUPPETFILE>   Path to the modules folder
+  --report=<FILE>             Write the modules updated, and what changed, to a JSON file
   --version                   Displays the version.
   --workers=<n>               Number of modules to download in parallel
 `
@@ -5,8 +5,9 @@ import (
 	"io/ioutil"
 	"log"
 	"path"
+	"strings"
 
-	"github.com/yannh/r10k-go/git"
+	"github.com/yannh/r10k-go/puppetmodule"
 	"github.com/yannh/r10k-go/puppetsource"
 )
 
@@ -30,7 +31,7 @@ func getEnvironments(envNames []string, sources []puppetsource.Source) []environ
 		// TODO: make deterministic
 		found := false
 		for _, source := range sources {
-			if git.RepoHasRemoteBranch(source.Remote(), envName) {
+			if hasEnvironment(source, envName) {
 				envs = append(envs, newEnvironment(source, envName))
 				found = true
 				break
@@ -45,6 +46,21 @@ func getEnvironments(envNames []string, sources []puppetsource.Source) []environ
 	return envs
 }
 
+func hasEnvironment(source puppetsource.Source, envName string) bool {
+	envs, err := source.Environments()
+	if err != nil {
+		return false
+	}
+
+	for _, env := range envs {
+		if env == envName {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (e *environment) installedModules() []string {
 	folder := path.Join(e.source.Basedir(), e.branch, e.modulesFolder)
 
@@ -62,19 +78,17 @@ func (e *environment) installedModules() []string {
 }
 
 func (env *environment) fetch(cache *cache) error {
-	s := env.source.(*puppetsource.GitSource) // FIXME should use interface instead of checkout/clone
-	if err := s.Fetch(cache.folder); err != nil {
+	if err := env.source.Fetch(cache.folder); err != nil {
 		return err
 	}
 
-	if err := git.Checkout(s.Location(), git.NewRef(git.TypeBranch, env.branch)); err != nil {
-		return err
-	}
-	if err := git.Clone(s.Location(), path.Join(s.Basedir(), env.branch)); err != nil {
-		return err
-	}
+	export := puppetmodule.DefaultGitDeploy() == puppetmodule.DeployExport
+	return env.source.Deploy(env.branch, path.Join(env.source.Basedir(), env.branch), env.modulesFolder, cache.folder, export)
+}
 
-	return nil
+// commit returns the version of the source the environment is deployed from
+func (env *environment) commit() string {
+	return env.source.Version(env.branch)
 }
 
 func DeployedEnvironments(s puppetsource.Source) []environment {
@@ -88,6 +102,11 @@ func DeployedEnvironments(s puppetsource.Source) []environment {
 	envs := make([]environment, 0)
 
 	for _, f := range files {
+		// Locks, and environments being replaced
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
 		envs = append(envs, newEnvironment(s, f.Name()))
 	}
 
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/yannh/r10k-go/git"
+	"github.com/yannh/r10k-go/puppetmodule"
+)
+
+// environmentState is recorded after every successful deploy of an environment,
+// so the environment can be skipped as long as nothing changed
+type environmentState struct {
+	Commit  string   `json:"commit"`  // Commit of the control repository
+	Modules []string `json:"modules"` // Folders of the deployed modules
+	Digest  string   `json:"digest"`  // Digest of the modules and their deployed versions
+}
+
+// environmentStates tracks the modules deployed for every environment during a deploy
+type environmentStates struct {
+	sync.Mutex
+	folder  string
+	modules map[string][]string
+	failed  map[string]bool
+}
+
+func newEnvironmentStates(cache *cache) *environmentStates {
+	return &environmentStates{
+		folder:  path.Join(cache.folder, "environments"),
+		modules: make(map[string][]string),
+		failed:  make(map[string]bool),
+	}
+}
+
+func envKey(env environment) string {
+	return path.Join(env.source.Basedir(), env.branch)
+}
+
+func (s *environmentStates) filename(env environment) string {
+	return path.Join(s.folder, git.RepoHash(envKey(env))+".json")
+}
+
+func (s *environmentStates) add(env environment, folder string) {
+	s.Lock()
+	s.modules[envKey(env)] = append(s.modules[envKey(env)], folder)
+	s.Unlock()
+}
+
+func (s *environmentStates) fail(env environment) {
+	s.Lock()
+	s.failed[envKey(env)] = true
+	s.Unlock()
+}
+
+// moduleVersion returns the version of the module deployed in folder
+func moduleVersion(folder string) string {
+	if commit := puppetmodule.DeployedCommit(folder); commit != "" {
+		return commit
+	}
+
+	var meta struct {
+		Version string `json:"version"`
+	}
+	if content, err := ioutil.ReadFile(path.Join(folder, "metadata.json")); err == nil {
+		json.Unmarshal(content, &meta)
+	}
+
+	return meta.Version
+}
+
+// modulesDigest returns a digest of the modules deployed in folders, which changes
+// if a module gets removed or updated
+func modulesDigest(folders []string) string {
+	sorted := append([]string{}, folders...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, folder := range sorted {
+		if _, err := os.Stat(folder); err != nil {
+			h.Write([]byte(folder + " missing\n"))
+			continue
+		}
+		h.Write([]byte(folder + " " + moduleVersion(folder) + "\n"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isUpToDate returns true if the environment was deployed from commit,
+// and its modules were not modified since
+func (s *environmentStates) isUpToDate(env environment, commit string) bool {
+	content, err := ioutil.ReadFile(s.filename(env))
+	if err != nil {
+		return false
+	}
+
+	var state environmentState
+	if err = json.Unmarshal(content, &state); err != nil {
+		return false
+	}
+
+	return state.Commit == commit && state.Digest == modulesDigest(state.Modules)
+}
+
+// skip returns true if the environment does not need to be deployed, unless forced:
+// it was deployed from commit, its modules were not modified since, and they are all
+// pinned to a version. Other modules may have been updated upstream.
+func (s *environmentStates) skip(env environment, pf *puppetFile, commit string, force bool) bool {
+	return !force && !pf.hasFloatingModules() && s.isUpToDate(env, commit)
+}
+
+// save records the state of all environments deployed without errors
+func (s *environmentStates) save(envs []environment, commits map[string]string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := os.MkdirAll(s.folder, 0755); err != nil {
+		return err
+	}
+
+	for _, env := range envs {
+		key := envKey(env)
+		if s.failed[key] || commits[key] == "" {
+			os.Remove(s.filename(env))
+			continue
+		}
+
+		state := environmentState{Commit: commits[key], Modules: s.modules[key], Digest: modulesDigest(s.modules[key])}
+		if state.Modules == nil {
+			state.Modules = make([]string, 0)
+		}
+
+		content, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		if err = ioutil.WriteFile(s.filename(env), content, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
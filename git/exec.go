@@ -0,0 +1,379 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/yannh/r10k-go/archive"
+)
+
+// ExecBackend runs the git binary for every operation
+type ExecBackend struct{}
+
+func NewExecBackend() *ExecBackend {
+	return &ExecBackend{}
+}
+
+func (b *ExecBackend) RevParse(path string) error {
+	cmd := exec.Command("git", "rev-parse")
+	cmd.Dir = path
+	return cmd.Run()
+}
+
+func (b *ExecBackend) Clone(repo string, to string, opts CloneOptions) error {
+	cmdParameters := "clone"
+
+	if opts.Depth > 0 {
+		cmdParameters += " --depth " + strconv.Itoa(opts.Depth) + " --no-single-branch"
+	}
+
+	if opts.Filter != "" {
+		cmdParameters += " --filter=" + opts.Filter
+	}
+
+	cmdParameters += " " + repo + " " + to
+
+	cmd := exec.Command("git", strings.Split(cmdParameters, " ")...)
+	fmt.Println("Running git " + cmdParameters)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		err = fmt.Errorf("failed running git %s: %s", cmdParameters, string(output))
+		return err
+	}
+
+	return nil
+}
+
+func (b *ExecBackend) Fetch(path string) error {
+	cmd := exec.Command("git", "fetch")
+	cmd.Dir = path
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed running git fetch: %s", string(output))
+	}
+
+	return nil
+}
+
+func (b *ExecBackend) SetRemoteURL(path string, url string) error {
+	cmd := exec.Command("git", "remote", "set-url", "origin", url)
+	cmd.Dir = path
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed running git remote set-url: %s", string(output))
+	}
+
+	return nil
+}
+
+func (b *ExecBackend) Branches(path string) ([]string, error) {
+	cmd := exec.Command("git", "for-each-ref", "--format=%(refname)", "refs/remotes/origin/")
+	cmd.Dir = path
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed listing branches of %s: %v", path, err)
+	}
+
+	branches := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		branch := strings.TrimPrefix(scanner.Text(), "refs/remotes/origin/")
+		if branch != "HEAD" {
+			branches = append(branches, branch)
+		}
+	}
+
+	return branches, nil
+}
+
+func (b *ExecBackend) RemoteURL(path string) (string, error) {
+	cmd := exec.Command("git", "remote", "get-url", "origin")
+	cmd.Dir = path
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed running git remote get-url in %s", path)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (b *ExecBackend) Fsck(path string) error {
+	cmd := exec.Command("git", "fsck", "--no-progress", "--no-dangling")
+	cmd.Dir = path
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed running git fsck: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func (b *ExecBackend) Unshallow(path string) error {
+	fmt.Println("Running git fetch --unshallow --tags in " + path)
+	cmd := exec.Command("git", "fetch", "--unshallow", "--tags")
+	cmd.Dir = path
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed running git fetch --unshallow: %s", string(output))
+	}
+
+	return nil
+}
+
+func (b *ExecBackend) Checkout(path string, ref *Ref) error {
+	if ref == nil {
+		return nil
+	}
+
+	fmt.Println("Running git checkout " + ref.Ref)
+	cmd := exec.Command("git", "checkout", ref.Ref)
+	cmd.Dir = path
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed running git checkout: %s", string(output))
+	}
+
+	return nil
+}
+
+func (b *ExecBackend) ResolveRef(directory string, ref *Ref) (string, error) {
+	for _, revision := range ref.revisions() {
+		cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", revision+"^{commit}")
+		cmd.Dir = directory
+		if output, err := cmd.Output(); err == nil {
+			return strings.TrimSpace(string(output)), nil
+		}
+	}
+
+	return "", fmt.Errorf("failed resolving reference %s in %s", ref.revisions()[0], directory)
+}
+
+func (b *ExecBackend) SubmoduleCommit(directory string, ref *Ref, submodulePath string) (string, error) {
+	sha, err := b.ResolveRef(directory, ref)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("git", "rev-parse", sha+":"+submodulePath)
+	cmd.Dir = directory
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed finding submodule %s in %s", submodulePath, directory)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// VerifySignature imports the keyring in a temporary GnuPG home, so only its keys are trusted
+func (b *ExecBackend) VerifySignature(directory string, ref *Ref, keyring string) error {
+	sha, err := b.ResolveRef(directory, ref)
+	if err != nil {
+		return err
+	}
+
+	gnupgHome, err := ioutil.TempDir("", "r10k-go-gnupg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gnupgHome)
+	env := append(os.Environ(), "GNUPGHOME="+gnupgHome)
+
+	cmd := exec.Command("gpg", "--batch", "--quiet", "--import", keyring)
+	cmd.Env = env
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed importing keyring %s: %s", keyring, string(output))
+	}
+
+	verify := []string{"verify-commit", sha}
+	if ref != nil && ref.RefType == TypeTag {
+		cmd = exec.Command("git", "cat-file", "-t", "refs/tags/"+ref.Ref)
+		cmd.Dir = directory
+		if output, err := cmd.Output(); err == nil && strings.TrimSpace(string(output)) == "tag" {
+			verify = []string{"verify-tag", "refs/tags/" + ref.Ref}
+		}
+	}
+
+	fmt.Println("Running git " + strings.Join(verify, " "))
+	cmd = exec.Command("git", verify...)
+	cmd.Dir = directory
+	cmd.Env = env
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if len(output) == 0 {
+			return fmt.Errorf("no valid signature for %s: not signed", verify[1])
+		}
+		return fmt.Errorf("no valid signature for %s: %s", verify[1], strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func (b *ExecBackend) Changes(directory string, from string, to string, subdir string) (*Changes, error) {
+	changes := &Changes{From: from, To: to, Commits: make([]Commit, 0), Files: make([]string, 0)}
+
+	var pathspec []string
+	if subdir != "" {
+		pathspec = []string{"--", subdir}
+	}
+
+	cmd := exec.Command("git", append([]string{"log", "--format=%H %s", from + ".." + to}, pathspec...)...)
+	cmd.Dir = directory
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed running git log %s..%s: %s", from, to, string(output))
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		commit := Commit{SHA: fields[0]}
+		if len(fields) == 2 {
+			commit.Subject = fields[1]
+		}
+		changes.Commits = append(changes.Commits, commit)
+	}
+
+	cmd = exec.Command("git", append([]string{"diff", "--name-only", from, to}, pathspec...)...)
+	cmd.Dir = directory
+	if output, err = cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed running git diff %s %s: %s", from, to, string(output))
+	}
+
+	scanner = bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		changes.Files = append(changes.Files, scanner.Text())
+	}
+
+	return changes, nil
+}
+
+func (b *ExecBackend) Export(directory string, ref *Ref, subdir string, to string) error {
+	var stderr bytes.Buffer
+
+	sha, err := b.ResolveRef(directory, ref)
+	if err != nil {
+		return err
+	}
+
+	treeish := sha
+	if subdir != "" {
+		treeish += ":" + strings.Trim(subdir, "/")
+	}
+
+	// archive.Extract strips the first folder of every file in the archive
+	fmt.Println("Running git archive " + treeish)
+	cmd := exec.Command("git", "archive", "--format=tar", "--prefix=export/", treeish)
+	cmd.Dir = directory
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("failed running git archive: %v", err)
+	}
+
+	if err = archive.Extract(stdout, to); err != nil {
+		cmd.Wait()
+		return fmt.Errorf("failed exporting %s to %s: %v", sha, to, err)
+	}
+
+	if err = cmd.Wait(); err != nil {
+		return fmt.Errorf("failed running git archive: %s", stderr.String())
+	}
+
+	return nil
+}
+
+func (b *ExecBackend) ListRemoteBranches(repo string) ([]string, error) {
+	branches := make([]string, 0)
+
+	// When run inside a git repository, ls-remote resolves relative paths from its root
+	if _, err := os.Stat(repo); err == nil && !path.IsAbs(repo) {
+		cwd, _ := os.Getwd()
+		repo = path.Join(cwd, repo)
+	}
+
+	cmd := exec.Command("git", "ls-remote", "--heads", repo)
+	fmt.Println("Running git ls-remote --heads " + repo)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed running git ls-remote on %s: %v", repo, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "refs/heads/") {
+			branches = append(branches, strings.TrimPrefix(fields[1], "refs/heads/"))
+		}
+	}
+
+	return branches, nil
+}
+
+func (b *ExecBackend) WorktreeAdd(directory string, ref *Ref, to string) error {
+	var cmd *exec.Cmd
+	var cwd string
+	var err error
+	var output []byte
+
+	if _, err := os.Stat(path.Join(directory, ".git")); err != nil {
+		return fmt.Errorf("can not create worktree from %s: folder is not a git repository", directory)
+	}
+
+	if !path.IsAbs(to) {
+		cwd, _ = os.Getwd()
+		to = path.Join(cwd, to)
+	}
+
+	sha, err := b.ResolveRef(directory, ref)
+	if err != nil {
+		return err
+	}
+
+	cmdLineParameters := "worktree add --detach -f " + to + " " + sha
+
+	fmt.Println("Running git " + cmdLineParameters)
+	cmd = exec.Command("git", strings.Split(cmdLineParameters, " ")...)
+	cmd.Dir = directory
+	if output, err = cmd.CombinedOutput(); err != nil {
+		err = fmt.Errorf("failed running git %s: %s", cmdLineParameters, string(output))
+	}
+
+	return err
+}
+
+func (b *ExecBackend) WorktreeRemove(directory string, worktree string) error {
+	if !path.IsAbs(worktree) {
+		cwd, _ := os.Getwd()
+		worktree = path.Join(cwd, worktree)
+	}
+
+	fmt.Println("Running git worktree remove --force " + worktree)
+	cmd := exec.Command("git", "worktree", "remove", "--force", worktree)
+	cmd.Dir = directory
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed running git worktree remove: %s", string(output))
+	}
+
+	return nil
+}
+
+func (b *ExecBackend) WorktreePrune(directory string) error {
+	cmd := exec.Command("git", "worktree", "prune")
+	cmd.Dir = directory
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed running git worktree prune in %s: %s", directory, string(output))
+	}
+
+	return nil
+}
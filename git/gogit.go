@@ -0,0 +1,707 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// GoGitBackend implements all git operations in Go, and does not
+// require git to be installed
+type GoGitBackend struct{}
+
+func NewGoGitBackend() *GoGitBackend {
+	// go-git serves local repositories using git-upload-pack. When git is not installed,
+	// we serve them in-process instead - shallow clones of local repositories are then
+	// not supported.
+	if _, err := exec.LookPath("git"); err != nil {
+		client.InstallProtocol("file", server.NewServer(localLoader{}))
+	}
+
+	return &GoGitBackend{}
+}
+
+// localLoader opens local repositories in-process, be they bare or not
+type localLoader struct{}
+
+func (l localLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	dir := ep.Path
+	if _, err := os.Stat(path.Join(dir, ".git")); err == nil {
+		dir = path.Join(dir, ".git")
+	}
+
+	if _, err := os.Stat(path.Join(dir, "objects")); err != nil {
+		return nil, transport.ErrRepositoryNotFound
+	}
+
+	return filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault()), nil
+}
+
+func (b *GoGitBackend) open(directory string) (*gogit.Repository, error) {
+	if _, err := os.Stat(directory); err != nil {
+		return nil, err
+	}
+
+	return gogit.PlainOpenWithOptions(directory, &gogit.PlainOpenOptions{
+		DetectDotGit:          true,
+		EnableDotGitCommonDir: true,
+	})
+}
+
+func (b *GoGitBackend) RevParse(path string) error {
+	_, err := b.open(path)
+	return err
+}
+
+// Clone ignores opts.Filter, as go-git does not support partial clones
+func (b *GoGitBackend) Clone(repo string, to string, opts CloneOptions) error {
+	fmt.Println("Cloning " + repo)
+	if _, err := gogit.PlainClone(to, false, &gogit.CloneOptions{URL: repo, Depth: opts.Depth}); err != nil {
+		os.RemoveAll(to)
+		return fmt.Errorf("failed cloning %s: %v", repo, err)
+	}
+
+	return nil
+}
+
+func (b *GoGitBackend) Fetch(path string) error {
+	r, err := b.open(path)
+	if err != nil {
+		return err
+	}
+
+	err = r.Fetch(&gogit.FetchOptions{Tags: gogit.AllTags, Force: true})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return fmt.Errorf("failed fetching %s: %v", path, err)
+	}
+
+	return nil
+}
+
+func (b *GoGitBackend) SetRemoteURL(path string, url string) error {
+	r, err := b.open(path)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := r.Config()
+	if err != nil {
+		return err
+	}
+
+	remote, ok := cfg.Remotes["origin"]
+	if !ok {
+		return fmt.Errorf("repository %s has no remote origin", path)
+	}
+
+	if len(remote.URLs) == 1 && remote.URLs[0] == url {
+		return nil
+	}
+	remote.URLs = []string{url}
+
+	return r.SetConfig(cfg)
+}
+
+func (b *GoGitBackend) Branches(path string) ([]string, error) {
+	r, err := b.open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := r.References()
+	if err != nil {
+		return nil, fmt.Errorf("failed listing branches of %s: %v", path, err)
+	}
+
+	branches := make([]string, 0)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if strings.HasPrefix(name, "refs/remotes/origin/") && name != "refs/remotes/origin/HEAD" {
+			branches = append(branches, strings.TrimPrefix(name, "refs/remotes/origin/"))
+		}
+		return nil
+	})
+
+	return branches, err
+}
+
+func (b *GoGitBackend) RemoteURL(path string) (string, error) {
+	r, err := b.open(path)
+	if err != nil {
+		return "", err
+	}
+
+	remote, err := r.Remote("origin")
+	if err != nil || len(remote.Config().URLs) == 0 {
+		return "", fmt.Errorf("repository %s has no remote origin", path)
+	}
+
+	return remote.Config().URLs[0], nil
+}
+
+// Fsck reads every object of the repository, and checks its content matches its hash.
+// All references must point to existing objects.
+func (b *GoGitBackend) Fsck(path string) error {
+	r, err := b.open(path)
+	if err != nil {
+		return err
+	}
+
+	objects, err := r.Storer.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return err
+	}
+
+	err = objects.ForEach(func(o plumbing.EncodedObject) error {
+		reader, err := o.Reader()
+		if err != nil {
+			return fmt.Errorf("failed reading object %s: %v", o.Hash(), err)
+		}
+		defer reader.Close()
+
+		h := plumbing.NewHasher(o.Type(), o.Size())
+		if _, err = io.Copy(h, reader); err != nil {
+			return fmt.Errorf("failed reading object %s: %v", o.Hash(), err)
+		}
+
+		if h.Sum() != o.Hash() {
+			return fmt.Errorf("object %s is corrupted", o.Hash())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	refs, err := r.References()
+	if err != nil {
+		return err
+	}
+
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		if _, err := r.Storer.EncodedObject(plumbing.AnyObject, ref.Hash()); err != nil {
+			return fmt.Errorf("reference %s points to a missing object %s", ref.Name(), ref.Hash())
+		}
+
+		return nil
+	})
+}
+
+// Unshallow clones the full repository next to the shallow one, and replaces
+// its objects, as go-git can not deepen an existing clone. Worktrees are kept.
+func (b *GoGitBackend) Unshallow(path string) error {
+	r, err := b.open(path)
+	if err != nil {
+		return err
+	}
+
+	remote, err := r.Remote("origin")
+	if err != nil {
+		return err
+	}
+
+	full := path + ".unshallow"
+	os.RemoveAll(full)
+	defer os.RemoveAll(full)
+
+	if err = b.Clone(remote.Config().URLs[0], full, CloneOptions{}); err != nil {
+		return err
+	}
+
+	// The shallow objects are only removed once the full ones are in place
+	objects := filepath.Join(path, ".git", "objects")
+	shallowObjects := objects + ".shallow"
+	os.RemoveAll(shallowObjects)
+	if err = os.Rename(objects, shallowObjects); err != nil {
+		return fmt.Errorf("failed unshallowing %s: %v", path, err)
+	}
+
+	if err = os.Rename(filepath.Join(full, ".git", "objects"), objects); err != nil {
+		os.Rename(shallowObjects, objects)
+		return fmt.Errorf("failed unshallowing %s: %v", path, err)
+	}
+	os.RemoveAll(shallowObjects)
+
+	if err = os.Remove(filepath.Join(path, ".git", "shallow")); err != nil {
+		return err
+	}
+
+	return b.Fetch(path)
+}
+
+func (b *GoGitBackend) resolve(r *gogit.Repository, ref *Ref) (plumbing.Hash, error) {
+	for _, revision := range ref.revisions() {
+		if h, err := r.ResolveRevision(plumbing.Revision(revision)); err == nil {
+			return *h, nil
+		}
+	}
+
+	return plumbing.ZeroHash, fmt.Errorf("failed resolving reference %s", ref.revisions()[0])
+}
+
+func (b *GoGitBackend) ResolveRef(directory string, ref *Ref) (string, error) {
+	r, err := b.open(directory)
+	if err != nil {
+		return "", err
+	}
+
+	h, err := b.resolve(r, ref)
+	if err != nil {
+		return "", fmt.Errorf("%v in %s", err, directory)
+	}
+
+	return h.String(), nil
+}
+
+func (b *GoGitBackend) Checkout(path string, ref *Ref) error {
+	if ref == nil {
+		return nil
+	}
+
+	r, err := b.open(path)
+	if err != nil {
+		return err
+	}
+
+	h, err := b.resolve(r, ref)
+	if err != nil {
+		return err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if err = w.Checkout(&gogit.CheckoutOptions{Hash: h, Force: true}); err != nil {
+		return fmt.Errorf("failed checking out %s: %v", ref.Ref, err)
+	}
+
+	return nil
+}
+
+func (b *GoGitBackend) SubmoduleCommit(directory string, ref *Ref, submodulePath string) (string, error) {
+	r, err := b.open(directory)
+	if err != nil {
+		return "", err
+	}
+
+	h, err := b.resolve(r, ref)
+	if err != nil {
+		return "", err
+	}
+
+	commit, err := r.CommitObject(h)
+	if err != nil {
+		return "", err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	entry, err := tree.FindEntry(submodulePath)
+	if err != nil || entry.Mode != filemode.Submodule {
+		return "", fmt.Errorf("failed finding submodule %s in %s", submodulePath, directory)
+	}
+
+	return entry.Hash.String(), nil
+}
+
+func (b *GoGitBackend) VerifySignature(directory string, ref *Ref, keyring string) error {
+	armoredKeyRing, err := ioutil.ReadFile(keyring)
+	if err != nil {
+		return fmt.Errorf("failed reading keyring %s: %v", keyring, err)
+	}
+
+	r, err := b.open(directory)
+	if err != nil {
+		return err
+	}
+
+	if ref != nil && ref.RefType == TypeTag {
+		if t, err := r.Tag(ref.Ref); err == nil {
+			if tag, err := r.TagObject(t.Hash()); err == nil {
+				if tag.PGPSignature == "" {
+					return fmt.Errorf("no valid signature for tag %s: not signed", ref.Ref)
+				}
+				if _, err = tag.Verify(string(armoredKeyRing)); err != nil {
+					return fmt.Errorf("no valid signature for tag %s: %v", ref.Ref, err)
+				}
+				return nil
+			}
+		}
+	}
+
+	h, err := b.resolve(r, ref)
+	if err != nil {
+		return err
+	}
+
+	commit, err := r.CommitObject(h)
+	if err != nil {
+		return err
+	}
+
+	if commit.PGPSignature == "" {
+		return fmt.Errorf("no valid signature for %s: not signed", h.String())
+	}
+
+	if _, err = commit.Verify(string(armoredKeyRing)); err != nil {
+		return fmt.Errorf("no valid signature for %s: %v", h.String(), err)
+	}
+
+	return nil
+}
+
+// subtreeHash returns the hash of the folder subdir in the commit, or of the whole tree
+// if subdir is empty. The hash is zero if the folder does not exist.
+func subtreeHash(c *object.Commit, subdir string) plumbing.Hash {
+	if subdir == "" {
+		return c.TreeHash
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+
+	entry, err := tree.FindEntry(subdir)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+
+	return entry.Hash
+}
+
+// changesSubdir returns true if the commit changed subdir, like git log -- subdir:
+// merges only do if subdir differs from all of their parents
+func changesSubdir(c *object.Commit, subdir string) bool {
+	if subdir == "" {
+		return true
+	}
+
+	h := subtreeHash(c, subdir)
+	if c.NumParents() == 0 {
+		return !h.IsZero()
+	}
+
+	changed := true
+	c.Parents().ForEach(func(parent *object.Commit) error {
+		if subtreeHash(parent, subdir) == h {
+			changed = false
+		}
+		return nil
+	})
+
+	return changed
+}
+
+func (b *GoGitBackend) Changes(directory string, from string, to string, subdir string) (*Changes, error) {
+	changes := &Changes{From: from, To: to, Commits: make([]Commit, 0), Files: make([]string, 0)}
+
+	r, err := b.open(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	fromCommit, err := r.CommitObject(plumbing.NewHash(from))
+	if err != nil {
+		return nil, fmt.Errorf("failed finding commit %s: %v", from, err)
+	}
+
+	toCommit, err := r.CommitObject(plumbing.NewHash(to))
+	if err != nil {
+		return nil, fmt.Errorf("failed finding commit %s: %v", to, err)
+	}
+
+	known := make(map[plumbing.Hash]bool)
+	err = object.NewCommitPreorderIter(fromCommit, nil, nil).ForEach(func(c *object.Commit) error {
+		known[c.Hash] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = object.NewCommitPreorderIter(toCommit, known, nil).ForEach(func(c *object.Commit) error {
+		if !changesSubdir(c, subdir) {
+			return nil
+		}
+
+		subject := strings.SplitN(c.Message, "\n", 2)[0]
+		changes.Commits = append(changes.Commits, Commit{SHA: c.Hash.String(), Subject: subject})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fromTree, err := fromCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	toTree, err := toCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	diff, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range diff {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		if subdir != "" && !strings.HasPrefix(name, subdir+"/") {
+			continue
+		}
+		changes.Files = append(changes.Files, name)
+	}
+	sort.Strings(changes.Files)
+
+	return changes, nil
+}
+
+func (b *GoGitBackend) Export(directory string, ref *Ref, subdir string, to string) error {
+	r, err := b.open(directory)
+	if err != nil {
+		return err
+	}
+
+	h, err := b.resolve(r, ref)
+	if err != nil {
+		return err
+	}
+
+	commit, err := r.CommitObject(h)
+	if err != nil {
+		return err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	if subdir = strings.Trim(subdir, "/"); subdir != "" {
+		if tree, err = tree.Tree(subdir); err != nil {
+			return fmt.Errorf("failed finding %s in %s: %v", subdir, h.String(), err)
+		}
+	}
+
+	if err = os.MkdirAll(to, 0755); err != nil {
+		return err
+	}
+
+	return tree.Files().ForEach(func(f *object.File) error {
+		return exportFile(f, path.Join(to, f.Name))
+	})
+}
+
+func exportFile(f *object.File, to string) error {
+	if err := os.MkdirAll(path.Dir(to), 0755); err != nil {
+		return fmt.Errorf("failed creating %s: %v", path.Dir(to), err)
+	}
+
+	if f.Mode == filemode.Symlink {
+		target, err := f.Contents()
+		if err != nil {
+			return err
+		}
+
+		return os.Symlink(target, to)
+	}
+
+	mode, err := f.Mode.ToOSFileMode()
+	if err != nil {
+		return err
+	}
+
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("failed creating %s: %v", to, err)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, r)
+
+	return err
+}
+
+func (b *GoGitBackend) ListRemoteBranches(repo string) ([]string, error) {
+	branches := make([]string, 0)
+
+	remote := gogit.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{repo}})
+	refs, err := remote.List(&gogit.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed listing branches of %s: %v", repo, err)
+	}
+
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			branches = append(branches, ref.Name().Short())
+		}
+	}
+
+	return branches, nil
+}
+
+// WorktreeAdd registers a detached worktree the same way git worktree add does,
+// so the result can be used by both backends
+func (b *GoGitBackend) WorktreeAdd(directory string, ref *Ref, to string) error {
+	var err error
+
+	if _, err = os.Stat(path.Join(directory, ".git")); err != nil {
+		return fmt.Errorf("can not create worktree from %s: folder is not a git repository", directory)
+	}
+
+	if to, err = filepath.Abs(to); err != nil {
+		return err
+	}
+
+	gitDir, err := filepath.Abs(path.Join(directory, ".git"))
+	if err != nil {
+		return err
+	}
+
+	r, err := b.open(directory)
+	if err != nil {
+		return err
+	}
+
+	h, err := b.resolve(r, ref)
+	if err != nil {
+		return err
+	}
+
+	// Worktree names have to be unique in a repository
+	name := path.Base(to)
+	adminDir := path.Join(gitDir, "worktrees", name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(adminDir); os.IsNotExist(err) {
+			break
+		}
+		adminDir = path.Join(gitDir, "worktrees", name+strconv.Itoa(i))
+	}
+
+	if err = os.MkdirAll(adminDir, 0755); err != nil {
+		return fmt.Errorf("failed creating %s: %v", adminDir, err)
+	}
+
+	if err = os.MkdirAll(to, 0755); err != nil {
+		return fmt.Errorf("failed creating %s: %v", to, err)
+	}
+
+	files := map[string]string{
+		path.Join(adminDir, "commondir"): "../..\n",
+		path.Join(adminDir, "gitdir"):    path.Join(to, ".git") + "\n",
+		path.Join(adminDir, "HEAD"):      h.String() + "\n",
+		path.Join(to, ".git"):            "gitdir: " + adminDir + "\n",
+	}
+	for filename, content := range files {
+		if err = ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed creating worktree %s: %v", to, err)
+		}
+	}
+
+	worktree, err := b.open(to)
+	if err != nil {
+		return err
+	}
+
+	w, err := worktree.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if err = w.Checkout(&gogit.CheckoutOptions{Hash: h, Force: true}); err != nil {
+		return fmt.Errorf("failed creating worktree %s: %v", to, err)
+	}
+
+	return nil
+}
+
+func (b *GoGitBackend) WorktreeRemove(directory string, worktree string) error {
+	adminDir, err := worktreeAdminDir(worktree)
+	if err != nil {
+		return err
+	}
+
+	if err = os.RemoveAll(worktree); err != nil {
+		return fmt.Errorf("failed removing worktree %s: %v", worktree, err)
+	}
+
+	return os.RemoveAll(adminDir)
+}
+
+// WorktreePrune removes the registration of worktrees whose folder was deleted,
+// unless they were locked with git worktree lock
+func (b *GoGitBackend) WorktreePrune(directory string) error {
+	worktreesDir := path.Join(directory, ".git", "worktrees")
+
+	adminDirs, err := ioutil.ReadDir(worktreesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, adminDir := range adminDirs {
+		adminPath := path.Join(worktreesDir, adminDir.Name())
+		if _, err := os.Stat(path.Join(adminPath, "locked")); err == nil {
+			continue
+		}
+
+		gitdir, err := ioutil.ReadFile(path.Join(adminPath, "gitdir"))
+		if err == nil {
+			if _, err = os.Stat(strings.TrimSpace(string(gitdir))); err == nil {
+				continue
+			}
+		}
+
+		if err = os.RemoveAll(adminPath); err != nil {
+			return fmt.Errorf("failed pruning worktree %s: %v", adminDir.Name(), err)
+		}
+	}
+
+	return nil
+}
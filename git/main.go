@@ -1,9 +1,9 @@
 package git
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path"
 	"regexp"
 	"strings"
@@ -18,6 +18,86 @@ type Ref struct {
 	Ref     string
 }
 
+// CloneOptions limit how much of a repository gets downloaded
+type CloneOptions struct {
+	Depth  int    // Only fetch the last Depth commits of every branch
+	Filter string // Partial clone filter, eg blob:none
+}
+
+// Commit is an entry of the log of a repository
+type Commit struct {
+	SHA     string `json:"sha"`
+	Subject string `json:"subject"`
+}
+
+// Changes lists the commits and files that changed between two commits
+type Changes struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Commits []Commit `json:"commits"`
+	Files   []string `json:"files"`
+}
+
+// Backend is implemented by ExecBackend, which runs the git binary,
+// and GoGitBackend, a pure Go implementation
+type Backend interface {
+	Branches(directory string) ([]string, error)
+	Changes(directory string, from string, to string, subdir string) (*Changes, error)
+	Checkout(directory string, ref *Ref) error
+	Clone(repo string, to string, opts CloneOptions) error
+	Export(directory string, ref *Ref, subdir string, to string) error
+	Fetch(directory string) error
+	Fsck(directory string) error
+	ListRemoteBranches(repo string) ([]string, error)
+	ResolveRef(directory string, ref *Ref) (string, error)
+	RemoteURL(directory string) (string, error)
+	RevParse(directory string) error
+	SetRemoteURL(directory string, url string) error
+	SubmoduleCommit(directory string, ref *Ref, submodulePath string) (string, error)
+	Unshallow(directory string) error
+	VerifySignature(directory string, ref *Ref, keyring string) error
+	WorktreeAdd(directory string, ref *Ref, to string) error
+	WorktreePrune(directory string) error
+	WorktreeRemove(directory string, worktree string) error
+}
+
+var backend Backend = NewExecBackend()
+var defaultCloneOptions CloneOptions
+var offline bool
+
+// ErrOffline is returned by the functions that would need to reach a remote repository
+// while offline
+var ErrOffline = errors.New("can not reach remote repositories while offline")
+
+// NewBackend returns the backend for a provider as set in r10k.yml,
+// shellgit being the default
+func NewBackend(provider string) (Backend, error) {
+	switch provider {
+	case "", "shellgit":
+		return NewExecBackend(), nil
+	case "go-git":
+		return NewGoGitBackend(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported git provider %s", provider)
+}
+
+// SetBackend changes the backend used by all functions of this package
+func SetBackend(b Backend) {
+	backend = b
+}
+
+// SetOffline prevents any remote repository from being reached, only cached
+// repositories can then be used
+func SetOffline(o bool) {
+	offline = o
+}
+
+// SetDefaultCloneOptions sets the options used by Clone when none are given
+func SetDefaultCloneOptions(opts CloneOptions) {
+	defaultCloneOptions = opts
+}
+
 func sanitizeShellChars(s string) string {
 	reg := regexp.MustCompile("[']")
 	return reg.ReplaceAllString(s, "")
@@ -36,100 +116,160 @@ func NewRef(refType uint8, ref string) *Ref {
 	}
 }
 
-func RevParse(path string) error {
-	cmd := exec.Command("git", "rev-parse")
-	cmd.Dir = path
-	return cmd.Run()
+// Pinned returns true if the reference is a tag or the SHA1 of a commit, which do not
+// move as the repository is updated, unlike branches
+func (ref *Ref) Pinned() bool {
+	if ref == nil {
+		return false
+	}
+
+	switch ref.RefType {
+	case TypeTag:
+		return true
+	case TypeBranch:
+		return false
+	default:
+		return commitSHA.MatchString(ref.Ref)
+	}
 }
 
-func Clone(repo string, to string) error {
-	cmdParameters := "clone"
+var commitSHA = regexp.MustCompile("^[0-9a-fA-F]{40}$")
+
+// revisions returns the revisions a reference could match, by order of preference.
+// Branches are looked up on the remote first, as local branches are not updated by a fetch
+func (ref *Ref) revisions() []string {
+	if ref == nil {
+		return []string{"HEAD"}
+	}
+
+	switch ref.RefType {
+	case TypeBranch:
+		return []string{"refs/remotes/origin/" + ref.Ref, "refs/heads/" + ref.Ref}
+	case TypeTag:
+		return []string{"refs/tags/" + ref.Ref}
+	default:
+		return []string{"refs/remotes/origin/" + ref.Ref, ref.Ref}
+	}
+}
 
-	cmdParameters += " " + repo + " " + to
+func RevParse(path string) error { return backend.RevParse(path) }
 
-	cmd := exec.Command("git", strings.Split(cmdParameters, " ")...)
-	fmt.Println("Running git " + cmdParameters)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		err = fmt.Errorf("failed running git %s: %s", cmdParameters, string(output))
-		return err
+func Clone(repo string, to string, opts CloneOptions) error {
+	if offline {
+		return ErrOffline
 	}
 
-	return nil
+	if opts.Depth == 0 {
+		opts.Depth = defaultCloneOptions.Depth
+	}
+	if opts.Filter == "" {
+		opts.Filter = defaultCloneOptions.Filter
+	}
+
+	return cloneRemotes(repo, to, opts)
 }
 
 func Fetch(path string) error {
-	var err error
+	if offline {
+		return ErrOffline
+	}
+
+	return backend.Fetch(path)
+}
 
-	cmd := exec.Command("git", "fetch")
-	cmd.Dir = path
+// IsShallow returns true if the repository was cloned with a limited depth
+func IsShallow(directory string) bool {
+	_, err := os.Stat(path.Join(directory, ".git", "shallow"))
+	return err == nil
+}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
-		err = fmt.Errorf("failed running git fetch: %s", string(output))
+// Unshallow fetches the full history of a shallow repository
+func Unshallow(directory string) error {
+	if offline {
+		return ErrOffline
 	}
 
-	return err
+	return backend.Unshallow(directory)
 }
 
-func Checkout(path string, ref *Ref) error {
-	var err error
+func Checkout(path string, ref *Ref) error { return backend.Checkout(path, ref) }
 
-	if ref == nil {
-		return nil
-	}
+// Export writes the files of ref to the folder to, without any git metadata.
+// If subdir is set, only the files in that folder of the repository are exported.
+func Export(directory string, ref *Ref, subdir string, to string) error {
+	return backend.Export(directory, ref, subdir, to)
+}
 
-	fmt.Println("Running git checkout " + ref.Ref)
-	cmd := exec.Command("git", "checkout", ref.Ref)
-	cmd.Dir = path
+// ResolveRef returns the SHA of the commit ref points to
+func ResolveRef(directory string, ref *Ref) (string, error) {
+	return backend.ResolveRef(directory, ref)
+}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
-		err = fmt.Errorf("failed running git fetch: %s", string(output))
-	}
+// GetChanges returns the commits reachable from to but not from from, most recent first,
+// and the files that differ between both commits. If subdir is set, only the commits and
+// files changing that folder of the repository are returned.
+func GetChanges(directory string, from string, to string, subdir string) (*Changes, error) {
+	return backend.Changes(directory, from, to, strings.Trim(subdir, "/"))
+}
 
-	return err
+// SubmoduleCommit returns the SHA of the commit the submodule at submodulePath is pinned to in ref
+func SubmoduleCommit(directory string, ref *Ref, submodulePath string) (string, error) {
+	return backend.SubmoduleCommit(directory, ref, submodulePath)
 }
 
-func RepoHasRemoteBranch(origin string, branch string) bool {
-	cmd := exec.Command("git", "ls-remote", "--exit-code", "-h", origin, branch)
-	fmt.Println("Running git ls-remote --exit-code -h" + origin + " " + branch)
-	if err := cmd.Run(); err != nil {
-		return false
+// VerifySignature checks that ref is signed by one of the keys of the armored keyring file.
+// Annotated tags are verified with the signature of the tag, other refs with the signature
+// of the commit they point to.
+func VerifySignature(directory string, ref *Ref, keyring string) error {
+	if keyring == "" {
+		return fmt.Errorf("can not verify signature of %s: no keyring configured", ref.revisions()[0])
 	}
-	return true
+
+	return backend.VerifySignature(directory, ref, keyring)
 }
 
-func WorktreeAdd(directory string, ref *Ref, to string) error {
-	var cmd *exec.Cmd
-	var cwd string
+// ListRemoteBranches lists the branches of the first remote of repo that can be reached
+func ListRemoteBranches(repo string) ([]string, error) {
 	var err error
-	var output []byte
+	var branches []string
 
-	if _, err := os.Stat(path.Join(directory, ".git")); err != nil {
-		return fmt.Errorf("can not create worktree from %s: folder is not a git repository", directory)
+	if offline {
+		return nil, ErrOffline
 	}
 
-	if !path.IsAbs(to) {
-		cwd, _ = os.Getwd()
-		to = path.Join(cwd, to)
+	for _, url := range remotes(repo) {
+		if branches, err = backend.ListRemoteBranches(url); err == nil {
+			return branches, nil
+		}
 	}
 
-	cmdLineParameters := "worktree add --detach -f " + to
+	return nil, err
+}
+
+// Branches lists the branches of the origin remote, as last fetched to the repository
+func Branches(directory string) ([]string, error) { return backend.Branches(directory) }
 
-	if ref != nil {
-		switch ref.RefType {
-		case TypeBranch:
-			cmdLineParameters += " " + ref.Ref
+// RemoteURL returns the URL of the origin remote of the repository
+func RemoteURL(directory string) (string, error) { return backend.RemoteURL(directory) }
 
-		case TypeTag, TypeRef:
-			cmdLineParameters += " " + ref.Ref
-		}
+// Fsck checks the objects of the repository for corruption
+func Fsck(directory string) error { return backend.Fsck(directory) }
+
+func RepoHasRemoteBranch(origin string, branch string) bool {
+	branches, err := ListRemoteBranches(origin)
+	if err != nil {
+		return false
 	}
 
-	fmt.Println("Running git " + cmdLineParameters)
-	cmd = exec.Command("git", strings.Split(cmdLineParameters, " ")...)
-	cmd.Dir = directory
-	if output, err = cmd.CombinedOutput(); err != nil {
-		err = fmt.Errorf("failed running git %s: %s", cmdLineParameters, string(output))
+	for _, b := range branches {
+		if b == branch {
+			return true
+		}
 	}
 
-	return err
+	return false
+}
+
+func WorktreeAdd(directory string, ref *Ref, to string) error {
+	return backend.WorktreeAdd(directory, ref, to)
 }
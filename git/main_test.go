@@ -2,31 +2,64 @@ package git
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// Every test is run against all backends
+var backends = map[string]Backend{
+	"shellgit": NewExecBackend(),
+	"go-git":   NewGoGitBackend(),
+}
+
+var fixtures = []string{"test-fixtures/git-repo", "test-fixtures/git-repo-history", "test-fixtures/git-repo-signed", "test-fixtures/git-repo-submodule"}
+
 func TestMain(m *testing.M) {
 	os.RemoveAll("tmp")
-	if _, err := os.Stat("test-fixtures/git-repo/git"); err == nil {
-		os.Rename("test-fixtures/git-repo/git", "test-fixtures/git-repo/.git")
+	for _, fixture := range fixtures {
+		if _, err := os.Stat(fixture + "/git"); err == nil {
+			os.Rename(fixture+"/git", fixture+"/.git")
+		}
 	}
 	res := m.Run()
-	if _, err := os.Stat("test-fixtures/git-repo/.git"); err == nil {
-		os.Rename("test-fixtures/git-repo/.git", "test-fixtures/git-repo/git")
+	for _, fixture := range fixtures {
+		os.RemoveAll(fixture + "/.git/worktrees")
+		if _, err := os.Stat(fixture + "/.git"); err == nil {
+			os.Rename(fixture+"/.git", fixture+"/git")
+		}
 	}
+	os.RemoveAll("tmp")
 	os.Exit(res)
 }
 
-func TestCloneSuccess(t *testing.T) {
-	if err := Clone("test-fixtures/git-repo/", "tmp/git-repo"); err != nil {
-		fmt.Print(err)
-		t.Error(err.Error())
+func TestNewBackend(t *testing.T) {
+	for _, provider := range []string{"", "shellgit", "go-git"} {
+		if _, err := NewBackend(provider); err != nil {
+			t.Errorf("provider %s should be supported: %v", provider, err)
+		}
+	}
+
+	if _, err := NewBackend("rugged"); err == nil {
+		t.Error("provider rugged should not be supported")
 	}
+}
+
+func TestCloneSuccess(t *testing.T) {
+	for name, b := range backends {
+		if err := b.Clone("test-fixtures/git-repo/", "tmp/"+name+"/git-repo", CloneOptions{}); err != nil {
+			fmt.Print(err)
+			t.Error(err.Error())
+		}
 
-	filename := "tmp/git-repo/readme.md"
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		t.Error("cloning failed; failed to create " + filename)
+		filename := "tmp/" + name + "/git-repo/readme.md"
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			t.Error(name + ": cloning failed; failed to create " + filename)
+		}
 	}
 
 	os.RemoveAll("tmp")
@@ -34,30 +67,640 @@ func TestCloneSuccess(t *testing.T) {
 
 func TestCloneNonRepo(t *testing.T) {
 	var err error
-	if err = Clone("test-fixtures/not-a-git-repo/", "tmp/git-repo"); err == nil {
-		t.Error("cloning a non existing repository should fail")
+	for name, b := range backends {
+		if err = b.Clone("test-fixtures/not-a-git-repo/", "tmp/"+name+"/git-repo", CloneOptions{}); err == nil {
+			t.Error(name + ": cloning a non existing repository should fail")
+		}
 	}
 }
 
-func TestRepoHasRemoteBranchFailure(t *testing.T) {
-	if RepoHasRemoteBranch("test-fixtures/git-repo/", "not-a-branch") == true {
-		t.Error("repository test-fixtures/git-repo/ should not have a branch not-a-branch")
+func TestShallowClone(t *testing.T) {
+	// Local clones ignore the depth unless the file:// protocol is used
+	cwd, _ := os.Getwd()
+	repo := "file://" + cwd + "/test-fixtures/git-repo-history"
+
+	for name, b := range backends {
+		to := "tmp/" + name + "/git-repo-history"
+		if err := b.Clone(repo, to, CloneOptions{Depth: 1}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if !IsShallow(to) {
+			t.Errorf("%s: cloning with a depth of 1 should create a shallow repository", name)
+		}
+
+		if _, err := b.ResolveRef(to, NewRef(TypeTag, "v3")); err != nil {
+			t.Errorf("%s: tag v3 should be part of a shallow clone: %v", name, err)
+		}
+
+		if err := b.Unshallow(to); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if IsShallow(to) {
+			t.Errorf("%s: repository should not be shallow after being unshallowed", name)
+		}
+
+		if sha, err := b.ResolveRef(to, NewRef(TypeTag, "v1")); err != nil || sha != "e5da3663ea61f321e425c28b1632d39d241d9aef" {
+			t.Errorf("%s: tag v1 should be resolvable after unshallowing: %v", name, err)
+		}
 	}
+
+	os.RemoveAll("tmp")
 }
 
-func TestWorktreeAdd(t *testing.T) {
-	if err := WorktreeAdd("test-fixtures/git-repo/", nil, "tmp/git-repo"); err != nil {
+func TestRewriteURL(t *testing.T) {
+	err := SetURLRewrites([]URLRule{
+		{Prefix: "https://github.com/", Replacement: "https://git.example.com/github/"},
+		{Regex: "^git://github.com/(.*)$", Replacement: "https://git.example.com/github/$1"},
+	})
+	if err != nil {
 		t.Error(err)
 	}
 
-	filename := "tmp/git-repo/readme.md"
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		t.Error("creating worktree failed; failed to create " + filename)
+	testCases := []struct {
+		url, expected string
+	}{
+		{"https://github.com/puppetlabs/puppetlabs-stdlib.git", "https://git.example.com/github/puppetlabs/puppetlabs-stdlib.git"},
+		{"git://github.com/puppetlabs/puppetlabs-stdlib.git", "https://git.example.com/github/puppetlabs/puppetlabs-stdlib.git"},
+		{"https://gitlab.com/org/repo.git", "https://gitlab.com/org/repo.git"},
+	}
+
+	for _, c := range testCases {
+		if actual := RewriteURL(c.url); actual != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, actual)
+		}
+	}
+
+	if err = SetURLRewrites([]URLRule{{Regex: "(", Replacement: "x"}}); err == nil {
+		t.Error("setting an invalid regex should fail")
+	}
+
+	if err = SetURLRewrites([]URLRule{{Replacement: "x"}}); err == nil {
+		t.Error("setting a rule without prefix nor regex should fail")
+	}
+
+	SetURLRewrites(nil)
+}
+
+func TestMirrors(t *testing.T) {
+	SetMirrors([]URLRule{{Prefix: "test-fixtures/not-a-git-repo", Replacement: "test-fixtures/git-repo"}})
+
+	for name, b := range backends {
+		SetBackend(b)
+		to := "tmp/" + name + "/git-repo"
+		if err := Clone("test-fixtures/not-a-git-repo/", to, CloneOptions{}); err != nil {
+			t.Errorf("%s: cloning should fall back to the mirror: %v", name, err)
+		}
+
+		if err := FetchRemote(to, "test-fixtures/not-a-git-repo/"); err != nil {
+			t.Errorf("%s: fetching should fall back to the mirror: %v", name, err)
+		}
+
+		if !RepoHasRemoteBranch("test-fixtures/not-a-git-repo/", "master") {
+			t.Errorf("%s: listing branches should fall back to the mirror", name)
+		}
+	}
+
+	SetBackend(NewExecBackend())
+	SetMirrors(nil)
+	os.RemoveAll("tmp")
+}
+
+func TestFetch(t *testing.T) {
+	for name, b := range backends {
+		if err := b.Clone("test-fixtures/git-repo/", "tmp/"+name+"/git-repo", CloneOptions{}); err != nil {
+			t.Error(err)
+		}
+
+		if err := b.Fetch("tmp/" + name + "/git-repo"); err != nil {
+			t.Errorf("%s: fetching an up-to-date repository should succeed: %v", name, err)
+		}
+
+		if err := b.Fetch("tmp/" + name + "/not-a-git-repo"); err == nil {
+			t.Error(name + ": fetching a non existing repository should fail")
+		}
+	}
+
+	os.RemoveAll("tmp")
+}
+
+func TestFsck(t *testing.T) {
+	for name, b := range backends {
+		repo := "tmp/" + name + "/git-repo"
+		if err := b.Clone("test-fixtures/git-repo/", repo, CloneOptions{}); err != nil {
+			t.Error(err)
+		}
+
+		if url, err := b.RemoteURL(repo); err != nil || !strings.HasSuffix(url, "test-fixtures/git-repo/") {
+			t.Errorf("%s: expected the remote URL to be test-fixtures/git-repo/, got %s %v", name, url, err)
+		}
+
+		if err := b.Fsck(repo); err != nil {
+			t.Errorf("%s: checking a cloned repository should succeed: %v", name, err)
+		}
+
+		// Objects are rewritten rather than modified in place, as they may be hardlinked to the fixture
+		filepath.Walk(path.Join(repo, ".git", "objects"), func(file string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() || strings.HasSuffix(file, ".idx") {
+				return nil
+			}
+
+			content, _ := ioutil.ReadFile(file)
+			for i := len(content) / 2; i < len(content)/2+16 && i < len(content); i++ {
+				content[i] ^= 0xff
+			}
+			os.Remove(file)
+			return ioutil.WriteFile(file, content, 0644)
+		})
+
+		if err := b.Fsck(repo); err == nil {
+			t.Errorf("%s: checking a corrupted repository should fail", name)
+		}
+	}
+
+	os.RemoveAll("tmp")
+}
+
+func TestResolveRef(t *testing.T) {
+	testCases := []struct {
+		ref      *Ref
+		expected string
+	}{
+		{nil, "4a1ab2ae890b049e3757fda320427ef018167096"},
+		{NewRef(TypeBranch, "master"), "4a1ab2ae890b049e3757fda320427ef018167096"},
+		{NewRef(TypeRef, "master"), "4a1ab2ae890b049e3757fda320427ef018167096"},
+		{NewRef(TypeRef, "4a1ab2ae890b049e3757fda320427ef018167096"), "4a1ab2ae890b049e3757fda320427ef018167096"},
+	}
+
+	for name, b := range backends {
+		for _, c := range testCases {
+			sha, err := b.ResolveRef("test-fixtures/git-repo/", c.ref)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			if sha != c.expected {
+				t.Errorf("%s: expected %s, got %s", name, c.expected, sha)
+			}
+		}
+
+		if _, err := b.ResolveRef("test-fixtures/git-repo/", NewRef(TypeTag, "not-a-tag")); err == nil {
+			t.Error(name + ": resolving a non existing tag should fail")
+		}
+	}
+}
+
+func TestRefPinned(t *testing.T) {
+	testCases := []struct {
+		ref    *Ref
+		pinned bool
+	}{
+		{NewRef(TypeTag, "v1"), true},
+		{NewRef(TypeRef, "4a1ab2ae890b049e3757fda320427ef018167096"), true},
+		{NewRef(TypeRef, "4a1ab2a"), false},
+		{NewRef(TypeRef, "main"), false},
+		{NewRef(TypeBranch, "main"), false},
+		{nil, false},
+	}
+
+	for _, c := range testCases {
+		if pinned := c.ref.Pinned(); pinned != c.pinned {
+			t.Errorf("expected %+v to be pinned: %v, got %v", c.ref, c.pinned, pinned)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	v1, v3 := "e5da3663ea61f321e425c28b1632d39d241d9aef", "9b763b82065543973278b5c3aa4fbc8c9b4f540a"
+
+	for name, b := range backends {
+		changes, err := b.Changes("test-fixtures/git-repo-history/", v1, v3, "")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if len(changes.Commits) != 2 || changes.Commits[0].SHA != v3 || changes.Commits[0].Subject != "v3" {
+			t.Errorf("%s: expected commits v3 and v2, got %+v", name, changes.Commits)
+		}
+
+		if len(changes.Files) != 1 || changes.Files[0] != "readme.md" {
+			t.Errorf("%s: expected readme.md to be changed, got %v", name, changes.Files)
+		}
+
+		if changes, err = b.Changes("test-fixtures/git-repo-history/", v3, v3, ""); err != nil || len(changes.Commits) != 0 || len(changes.Files) != 0 {
+			t.Errorf("%s: expected no changes between a commit and itself, got %+v: %v", name, changes, err)
+		}
+
+		if _, err = b.Changes("test-fixtures/git-repo-history/", "4a1ab2ae890b049e3757fda320427ef018167096", v3, ""); err == nil {
+			t.Errorf("%s: listing changes from a non existing commit should fail", name)
+		}
+	}
+}
+
+func TestChangesSubdir(t *testing.T) {
+	repo := "tmp/changes-subdir"
+	os.MkdirAll(path.Join(repo, "modules", "foo"), 0755)
+	os.MkdirAll(path.Join(repo, "modules", "bar"), 0755)
+
+	run := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("failed running git %v: %s", args, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	commit := func(file string, content string) string {
+		ioutil.WriteFile(path.Join(repo, file), []byte(content), 0644)
+		run("add", "-A")
+		run("commit", "-q", "-m", "update "+file)
+		return run("rev-parse", "HEAD")
+	}
+
+	run("init", "-q")
+	commit("modules/bar/init.pp", "v1")
+	from := commit("modules/foo/init.pp", "v1")
+	commit("modules/bar/init.pp", "v2")
+	to := commit("modules/foo/init.pp", "v2")
+
+	for name, b := range backends {
+		changes, err := b.Changes(repo, from, to, "modules/foo")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if len(changes.Commits) != 1 || changes.Commits[0].SHA != to {
+			t.Errorf("%s: expected only the commit changing modules/foo, got %+v", name, changes.Commits)
+		}
+
+		if len(changes.Files) != 1 || changes.Files[0] != "modules/foo/init.pp" {
+			t.Errorf("%s: expected only modules/foo/init.pp to be changed, got %v", name, changes.Files)
+		}
+	}
+
+	os.RemoveAll("tmp")
+}
+
+func TestVerifySignature(t *testing.T) {
+	testCases := []struct {
+		ref     *Ref
+		keyring string
+		valid   bool
+	}{
+		{NewRef(TypeTag, "v1"), "test-fixtures/keyring.asc", true},
+		{NewRef(TypeRef, "168a7bf9b721bb1290aa51e3ecc147825e70f0c9"), "test-fixtures/keyring.asc", true},
+		{NewRef(TypeTag, "v1"), "test-fixtures/untrusted-keyring.asc", false},
+		{NewRef(TypeTag, "v2"), "test-fixtures/keyring.asc", false},
+		{NewRef(TypeBranch, "master"), "test-fixtures/keyring.asc", false},
+		{NewRef(TypeTag, "v1"), "test-fixtures/not-a-keyring.asc", false},
+	}
+
+	for name, b := range backends {
+		for _, c := range testCases {
+			err := b.VerifySignature("test-fixtures/git-repo-signed/", c.ref, c.keyring)
+			if c.valid && err != nil {
+				t.Errorf("%s: signature of %s should be valid with %s: %v", name, c.ref.Ref, c.keyring, err)
+			}
+			if !c.valid && err == nil {
+				t.Errorf("%s: signature of %s should not be valid with %s", name, c.ref.Ref, c.keyring)
+			}
+		}
+	}
+
+	if err := VerifySignature("test-fixtures/git-repo-signed/", NewRef(TypeTag, "v1"), ""); err == nil {
+		t.Error("verifying a signature without keyring should fail")
+	}
+}
+
+func TestListRemoteBranches(t *testing.T) {
+	for name, b := range backends {
+		branches, err := b.ListRemoteBranches("test-fixtures/git-repo/")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if len(branches) != 1 || branches[0] != "master" {
+			t.Errorf("%s: expected branch master, got %v", name, branches)
+		}
+	}
+}
+
+func TestBranches(t *testing.T) {
+	for name, b := range backends {
+		repo := "tmp/" + name + "/git-repo"
+		if err := b.Clone("test-fixtures/git-repo/", repo, CloneOptions{}); err != nil {
+			t.Error(err)
+		}
+
+		branches, err := b.Branches(repo)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if len(branches) != 1 || branches[0] != "master" {
+			t.Errorf("%s: expected branch master, got %v", name, branches)
+		}
+	}
+
+	os.RemoveAll("tmp")
+}
+
+func TestOffline(t *testing.T) {
+	SetOffline(true)
+	defer SetOffline(false)
+
+	if err := Clone("test-fixtures/git-repo/", "tmp/offline/git-repo", CloneOptions{}); err != ErrOffline {
+		t.Errorf("expected cloning to fail while offline, got %v", err)
+	}
+
+	if _, err := ListRemoteBranches("test-fixtures/git-repo/"); err != ErrOffline {
+		t.Errorf("expected listing remote branches to fail while offline, got %v", err)
+	}
+
+	if _, err := os.Stat("tmp/offline"); !os.IsNotExist(err) {
+		t.Error("expected nothing to be cloned while offline")
+	}
+}
+
+func TestRepoHasRemoteBranchFailure(t *testing.T) {
+	for name, b := range backends {
+		SetBackend(b)
+		if RepoHasRemoteBranch("test-fixtures/git-repo/", "not-a-branch") == true {
+			t.Error(name + ": repository test-fixtures/git-repo/ should not have a branch not-a-branch")
+		}
+	}
+	SetBackend(NewExecBackend())
+}
+
+func TestExport(t *testing.T) {
+	for name, b := range backends {
+		if err := b.Export("test-fixtures/git-repo/", nil, "", "tmp/"+name+"/export"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		filename := "tmp/" + name + "/export/readme.md"
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			t.Error(name + ": exporting failed; failed to create " + filename)
+		}
+
+		if _, err := os.Stat("tmp/" + name + "/export/.git"); err == nil {
+			t.Error(name + ": exporting failed; export should not contain a .git")
+		}
+	}
+
+	os.RemoveAll("tmp")
+}
+
+func TestExportSubdirectory(t *testing.T) {
+	for name, b := range backends {
+		if err := b.Export("test-fixtures/git-repo-submodule/", nil, "modules", "tmp/"+name+"/export"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if _, err := os.Stat("tmp/" + name + "/export/readme.md"); err == nil {
+			t.Error(name + ": exporting a subdirectory should not export files outside of it")
+		}
+
+		if err := b.Export("test-fixtures/git-repo-submodule/", nil, "not-a-folder", "tmp/"+name+"/export"); err == nil {
+			t.Error(name + ": exporting a non existing subdirectory should fail")
+		}
+	}
+
+	os.RemoveAll("tmp")
+}
+
+func TestWorktreeAdd(t *testing.T) {
+	for name, b := range backends {
+		if err := b.WorktreeAdd("test-fixtures/git-repo/", nil, "tmp/"+name+"/git-repo"); err != nil {
+			t.Error(err)
+		}
+
+		filename := "tmp/" + name + "/git-repo/readme.md"
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			t.Error(name + ": creating worktree failed; failed to create " + filename)
+		}
+
+		// Worktrees created by one backend have to be usable by all
+		for otherName, other := range backends {
+			if sha, err := other.ResolveRef("tmp/"+name+"/git-repo", nil); err != nil || sha != "4a1ab2ae890b049e3757fda320427ef018167096" {
+				t.Errorf("%s: failed resolving HEAD of worktree created by %s: %v", otherName, name, err)
+			}
+		}
 	}
 }
 
 func TestWorktreeAddIncorrectPath(t *testing.T) {
-	if err := WorktreeAdd("test-fixtures/not-a-git-repo/", nil, "tmp/git-repo"); err == nil {
+	for name, b := range backends {
+		if err := b.WorktreeAdd("test-fixtures/not-a-git-repo/", nil, "tmp/"+name+"/git-repo"); err == nil {
+			t.Error(name + ": creating a worktree from a non existing repository should fail")
+		}
+	}
+}
+
+func TestRemoveWorktree(t *testing.T) {
+	for name, b := range backends {
+		SetBackend(b)
+		to := "tmp/" + name + "/remove-worktree"
+		if err := WorktreeAdd("test-fixtures/git-repo/", nil, to); err != nil {
+			t.Error(err)
+		}
+
+		if err := RemoveWorktree(to); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if _, err := os.Stat(to); err == nil {
+			t.Errorf("%s: removing worktree failed; %s still exists", name, to)
+		}
+
+		worktrees, _ := Worktrees("test-fixtures/git-repo/")
+		for _, w := range worktrees {
+			if path.Base(w) == "remove-worktree" {
+				t.Errorf("%s: removing worktree failed; worktree is still registered", name)
+			}
+		}
+	}
+	SetBackend(NewExecBackend())
+}
+
+func TestRemoveWorktreeSubmodulePaths(t *testing.T) {
+	to := "tmp/submodule-paths/worktree"
+	if err := WorktreeAdd("test-fixtures/git-repo/", nil, to); err != nil {
+		t.Fatal(err)
+	}
+
+	victim := "tmp/submodule-paths/victim"
+	os.MkdirAll(victim, 0755)
+	ioutil.WriteFile(path.Join(victim, "file"), []byte("keep"), 0644)
+	abs, _ := filepath.Abs(victim)
+	os.Symlink(abs, path.Join(to, "link"))
+
+	// Submodule paths come from the repository, and must not lead outside of the worktree
+	gitmodules := "[submodule \"up\"]\n\tpath = ../victim\n\turl = x\n" +
+		"[submodule \"abs\"]\n\tpath = " + abs + "\n\turl = x\n" +
+		"[submodule \"symlink\"]\n\tpath = link/file\n\turl = x\n"
+	if err := ioutil.WriteFile(path.Join(to, ".gitmodules"), []byte(gitmodules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The victim looks like a worktree, whose registration would be rewritten
+	adminDir, _ := filepath.Abs("tmp/submodule-paths/admin")
+	os.MkdirAll(adminDir, 0755)
+	ioutil.WriteFile(path.Join(victim, ".git"), []byte("gitdir: "+adminDir+"\n"), 0644)
+	ioutil.WriteFile(path.Join(adminDir, "gitdir"), []byte("unchanged\n"), 0644)
+
+	renamed := "tmp/submodule-paths/renamed"
+	if err := RenameWorktree(to, renamed); err != nil {
 		t.Error(err)
 	}
+
+	if gitdir, _ := ioutil.ReadFile(path.Join(adminDir, "gitdir")); string(gitdir) != "unchanged\n" {
+		t.Errorf("expected worktrees outside of the renamed worktree to be left alone, got %s", gitdir)
+	}
+
+	if err := RemoveWorktree(renamed); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Stat(path.Join(victim, "file")); err != nil {
+		t.Errorf("expected files outside of the worktree to be kept: %v", err)
+	}
+
+	os.RemoveAll("tmp/submodule-paths")
+}
+
+func TestRenameWorktree(t *testing.T) {
+	for name, b := range backends {
+		SetBackend(b)
+		from := "tmp/" + name + "/rename-worktree"
+		to := "tmp/" + name + "/renamed-worktree"
+		if err := WorktreeAdd("test-fixtures/git-repo/", nil, from); err != nil {
+			t.Error(err)
+		}
+
+		if err := RenameWorktree(from, to); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if !IsWorktreeOf(to, "test-fixtures/git-repo/") {
+			t.Errorf("%s: %s should be a worktree of test-fixtures/git-repo", name, to)
+		}
+
+		if _, err := ResolveRef(to, nil); err != nil {
+			t.Errorf("%s: renamed worktree is not usable: %v", name, err)
+		}
+
+		// Worktrees only stay registered at their new location
+		if err := WorktreePrune("test-fixtures/git-repo/"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if err := RemoveWorktree(to); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		worktrees, _ := Worktrees("test-fixtures/git-repo/")
+		for _, w := range worktrees {
+			if path.Base(w) == "rename-worktree" || path.Base(w) == "renamed-worktree" {
+				t.Errorf("%s: removing renamed worktree failed; %s is still registered", name, w)
+			}
+		}
+	}
+	SetBackend(NewExecBackend())
+}
+
+func TestWorktreePrune(t *testing.T) {
+	for name, b := range backends {
+		to := "tmp/" + name + "/prune-worktree"
+		if err := b.WorktreeAdd("test-fixtures/git-repo/", nil, to); err != nil {
+			t.Error(err)
+		}
+
+		worktrees, err := Worktrees("test-fixtures/git-repo/")
+		if err != nil || len(worktrees) == 0 {
+			t.Errorf("%s: worktree %s should be registered: %v", name, to, err)
+		}
+
+		os.RemoveAll(to)
+		if err = b.WorktreePrune("test-fixtures/git-repo/"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		worktrees, _ = Worktrees("test-fixtures/git-repo/")
+		for _, w := range worktrees {
+			if _, err := os.Stat(w); err != nil {
+				t.Errorf("%s: pruning failed; deleted worktree %s is still registered", name, w)
+			}
+		}
+	}
+}
+
+func TestUpdateSubmodules(t *testing.T) {
+	for name, b := range backends {
+		SetBackend(b)
+		to := "tmp/" + name + "/git-repo-submodule"
+		if err := WorktreeAdd("test-fixtures/git-repo-submodule/", nil, to); err != nil {
+			t.Error(err)
+		}
+
+		if err := UpdateSubmodules(to, "test-fixtures/git-repo-submodule", "tmp/"+name+"/cache"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		filename := to + "/modules/git-repo/readme.md"
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			t.Error(name + ": updating submodules failed; failed to create " + filename)
+		}
+
+		if _, err := os.Stat("tmp/" + name + "/cache/" + RepoHash("test-fixtures/git-repo")); err != nil {
+			t.Error(name + ": updating submodules failed; submodule repository was not cached")
+		}
+	}
+	SetBackend(NewExecBackend())
+}
+
+func TestExportSubmodules(t *testing.T) {
+	for name, b := range backends {
+		SetBackend(b)
+		to := "tmp/" + name + "/export-submodule"
+		if err := Export("test-fixtures/git-repo-submodule/", nil, "", to); err != nil {
+			t.Error(err)
+		}
+
+		if err := ExportSubmodules("test-fixtures/git-repo-submodule/", nil, to, "test-fixtures/git-repo-submodule", "tmp/"+name+"/cache"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		filename := to + "/modules/git-repo/readme.md"
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			t.Error(name + ": exporting submodules failed; failed to create " + filename)
+		}
+
+		if _, err := os.Stat(to + "/modules/git-repo/.git"); err == nil {
+			t.Error(name + ": exporting submodules failed; export should not contain a .git")
+		}
+	}
+	SetBackend(NewExecBackend())
+	os.RemoveAll("tmp")
+}
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	testCases := []struct {
+		remote, url, expected string
+	}{
+		{"https://github.com/org/repo.git", "https://github.com/org/other.git", "https://github.com/org/other.git"},
+		{"https://github.com/org/repo.git", "../other.git", "https://github.com/org/other.git"},
+		{"https://github.com/org/repo.git/", "./sub.git", "https://github.com/org/repo.git/sub.git"},
+		{"git@github.com:org/repo.git", "../../other/repo.git", "git@github.com:other/repo.git"},
+		{"test-fixtures/git-repo-submodule", "../git-repo", "test-fixtures/git-repo"},
+	}
+
+	for _, c := range testCases {
+		if actual := resolveSubmoduleURL(c.remote, c.url); actual != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, actual)
+		}
+	}
 }
@@ -0,0 +1,170 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// URLRule rewrites URLs starting with Prefix, or matching Regex. With a regex,
+// the replacement can reference submatches, eg $1
+type URLRule struct {
+	Prefix      string
+	Regex       string
+	Replacement string
+
+	re *regexp.Regexp
+}
+
+var urlRewrites []URLRule
+var mirrors []URLRule
+
+func compileURLRules(rules []URLRule) ([]URLRule, error) {
+	compiled := make([]URLRule, 0, len(rules))
+
+	for _, rule := range rules {
+		switch {
+		case rule.Prefix != "" && rule.Regex != "":
+			return nil, fmt.Errorf("url rule can not have both a prefix and a regex")
+
+		case rule.Regex != "":
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid url rule %s: %v", rule.Regex, err)
+			}
+			rule.re = re
+
+		case rule.Prefix == "":
+			return nil, fmt.Errorf("url rule should have a prefix or a regex")
+		}
+
+		compiled = append(compiled, rule)
+	}
+
+	return compiled, nil
+}
+
+// apply returns the rewritten URL, and whether the rule matched
+func (rule URLRule) apply(url string) (string, bool) {
+	if rule.re != nil {
+		if !rule.re.MatchString(url) {
+			return url, false
+		}
+		return rule.re.ReplaceAllString(url, rule.Replacement), true
+	}
+
+	if !strings.HasPrefix(url, rule.Prefix) {
+		return url, false
+	}
+
+	return rule.Replacement + strings.TrimPrefix(url, rule.Prefix), true
+}
+
+// SetURLRewrites sets the rules used to rewrite the URL of every repository,
+// similar to git's insteadOf. The first matching rule is applied.
+func SetURLRewrites(rules []URLRule) error {
+	compiled, err := compileURLRules(rules)
+	if err != nil {
+		return err
+	}
+
+	urlRewrites = compiled
+	return nil
+}
+
+// SetMirrors sets the rules generating the URLs of the mirrors of a repository,
+// tried in order when the repository can not be reached
+func SetMirrors(rules []URLRule) error {
+	compiled, err := compileURLRules(rules)
+	if err != nil {
+		return err
+	}
+
+	mirrors = compiled
+	return nil
+}
+
+// RewriteURL returns the URL a repository should be downloaded from
+func RewriteURL(repo string) string {
+	for _, rule := range urlRewrites {
+		if url, ok := rule.apply(repo); ok {
+			return url
+		}
+	}
+
+	return repo
+}
+
+// remotes returns the URL of the repository followed by the URLs of its mirrors
+func remotes(repo string) []string {
+	urls := []string{RewriteURL(repo)}
+
+	for _, rule := range mirrors {
+		url, ok := rule.apply(repo)
+		if !ok {
+			continue
+		}
+
+		known := false
+		for _, u := range urls {
+			known = known || u == url
+		}
+		if !known {
+			urls = append(urls, url)
+		}
+	}
+
+	return urls
+}
+
+// cloneRemotes clones the repository from the first of its remotes that succeeds
+func cloneRemotes(repo string, to string, opts CloneOptions) error {
+	var err error
+
+	for i, url := range remotes(repo) {
+		if i > 0 {
+			fmt.Printf("Failed cloning %s, trying mirror %s\n", repo, url)
+			os.RemoveAll(to)
+		}
+
+		if err = backend.Clone(url, to, opts); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// FetchRemote fetches the repository in directory from the first of the remotes
+// of repo that succeeds. The origin of the repository is set to that remote.
+func FetchRemote(directory string, repo string) error {
+	var err error
+
+	if offline {
+		return ErrOffline
+	}
+
+	for i, url := range remotes(repo) {
+		if i > 0 {
+			fmt.Printf("Failed fetching %s, trying mirror %s\n", repo, url)
+		}
+
+		// Like git clone, store local repositories with their absolute path, as
+		// relative paths would be resolved from directory
+		if _, err := os.Stat(url); err == nil && !filepath.IsAbs(url) {
+			url, _ = filepath.Abs(url)
+		}
+
+		if err = backend.SetRemoteURL(directory, url); err != nil {
+			return err
+		}
+
+		if err = backend.Fetch(directory); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,201 @@
+package git
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/yannh/r10k-go/lock"
+	"github.com/yannh/r10k-go/sidecar"
+)
+
+type submodule struct {
+	name string
+	path string
+	url  string
+}
+
+// RepoHash returns the name of the folder a repository is cached in
+func RepoHash(repo string) string {
+	hasher := sha1.New()
+	hasher.Write([]byte(repo))
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// parseGitmodules returns the submodules declared in a .gitmodules file
+func parseGitmodules(filename string) ([]submodule, error) {
+	submodules := make([]submodule, 0)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return submodules, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var current *submodule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+
+		case strings.HasPrefix(line, "[submodule"):
+			submodules = append(submodules, submodule{name: strings.Trim(line[len("[submodule"):], " \"]")})
+			current = &submodules[len(submodules)-1]
+
+		case current != nil && strings.Contains(line, "="):
+			kv := strings.SplitN(line, "=", 2)
+			switch strings.TrimSpace(kv[0]) {
+			case "path":
+				current.path = strings.Trim(kv[1], " \"")
+			case "url":
+				current.url = strings.Trim(kv[1], " \"")
+			}
+		}
+	}
+
+	return submodules, scanner.Err()
+}
+
+// resolveSubmoduleURL resolves URLs relative to the repository's remote,
+// such as ../other-module.git
+func resolveSubmoduleURL(remote, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+
+	base := strings.TrimSuffix(remote, "/")
+	separator := "/"
+	for {
+		switch {
+		case strings.HasPrefix(url, "./"):
+			url = url[2:]
+		case strings.HasPrefix(url, "../"):
+			url = url[3:]
+			// scp-like remotes, such as git@github.com:org/repo.git
+			if i := strings.LastIndexAny(base, "/:"); i >= 0 {
+				if base[i] == ':' {
+					separator = ":"
+				}
+				base = base[:i]
+			}
+		default:
+			return base + separator + url
+		}
+	}
+}
+
+// UpdateSubmodules recursively deploys the submodules of the worktree in directory,
+// remote being the repository the worktree was created from. Each submodule is cached
+// in its own repository in the cache folder, and deployed as a worktree of it.
+func UpdateSubmodules(directory, remote, cache string) error {
+	return deploySubmodules(directory, nil, directory, remote, cache, false)
+}
+
+// ExportSubmodules recursively exports the submodules of ref, from the repository in
+// directory, to the folder ref was exported to.
+func ExportSubmodules(directory string, ref *Ref, to, remote, cache string) error {
+	return deploySubmodules(directory, ref, to, remote, cache, true)
+}
+
+func deploySubmodules(directory string, ref *Ref, to, remote, cache string, export bool) error {
+	submodules, err := parseGitmodules(path.Join(to, ".gitmodules"))
+	if err != nil {
+		return fmt.Errorf("failed parsing submodules of %s: %v", to, err)
+	}
+
+	for _, s := range submodules {
+		if s.path == "" || s.url == "" {
+			return fmt.Errorf("submodule %s of %s is missing a path or url", s.name, to)
+		}
+
+		// .gitmodules is part of the repository, submodules can not be deployed outside of it
+		if !isRelativePath(s.path) {
+			return fmt.Errorf("submodule %s of %s has an invalid path %s", s.name, to, s.path)
+		}
+
+		if err = deploySubmodule(directory, ref, to, remote, cache, export, s); err != nil {
+			return fmt.Errorf("failed deploying submodule %s: %v", s.name, err)
+		}
+	}
+
+	return nil
+}
+
+// deploySubmodule deploys a submodule from its cached repository, which is locked
+// while it is updated and deployed
+func deploySubmodule(directory string, ref *Ref, to, remote, cache string, export bool, s submodule) error {
+	url := resolveSubmoduleURL(remote, s.url)
+	cacheFolder := path.Join(cache, RepoHash(url))
+
+	l, err := lock.Acquire(cacheFolder + ".lock")
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	sha, err := SubmoduleCommit(directory, ref, s.path)
+	if err != nil {
+		return err
+	}
+	submoduleRef := NewRef(TypeRef, sha)
+
+	if offline {
+		if RevParse(cacheFolder) != nil {
+			return fmt.Errorf("repository %s is not in the cache", url)
+		}
+		if _, err = ResolveRef(cacheFolder, submoduleRef); err != nil {
+			return fmt.Errorf("commit %s of %s is not in the cache", sha, url)
+		}
+	} else if RevParse(cacheFolder) != nil {
+		os.RemoveAll(cacheFolder)
+		if err = Clone(url, cacheFolder, CloneOptions{}); err != nil {
+			return err
+		}
+		if err = sidecar.Record(cache, RepoHash(url), url, ""); err != nil {
+			return err
+		}
+	} else if _, err = ResolveRef(cacheFolder, submoduleRef); err != nil {
+		if err = FetchRemote(cacheFolder, url); err != nil {
+			return err
+		}
+		if err = sidecar.Record(cache, RepoHash(url), url, ""); err != nil {
+			return err
+		}
+	}
+
+	if _, err = ResolveRef(cacheFolder, submoduleRef); err != nil && IsShallow(cacheFolder) {
+		if err = Unshallow(cacheFolder); err != nil {
+			return err
+		}
+	}
+
+	submoduleTo := path.Join(to, s.path)
+	if export {
+		err = Export(cacheFolder, submoduleRef, "", submoduleTo)
+		if err == nil {
+			err = deploySubmodules(cacheFolder, submoduleRef, submoduleTo, url, cache, true)
+		}
+	} else {
+		// Submodules deployed previously are updated in place
+		if IsWorktreeOf(submoduleTo, cacheFolder) {
+			err = Checkout(submoduleTo, submoduleRef)
+		} else if err = RemoveWorktree(submoduleTo); err == nil {
+			err = WorktreeAdd(cacheFolder, submoduleRef, submoduleTo)
+		}
+		if err == nil {
+			err = deploySubmodules(submoduleTo, nil, submoduleTo, url, cache, false)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,213 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Worktrees are registered in the .git/worktrees folder of their repository,
+// in the same format for all backends
+
+// worktreeAdminDir returns the folder a worktree is registered in, read from its .git file
+func worktreeAdminDir(worktree string) (string, error) {
+	content, err := ioutil.ReadFile(path.Join(worktree, ".git"))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a worktree: %v", worktree, err)
+	}
+
+	if !strings.HasPrefix(string(content), "gitdir: ") {
+		return "", fmt.Errorf("%s is not a worktree", worktree)
+	}
+
+	adminDir := strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir: "))
+	if !filepath.IsAbs(adminDir) {
+		adminDir = path.Join(worktree, adminDir)
+	}
+
+	return adminDir, nil
+}
+
+// worktreeRepository returns the repository a worktree was created from
+func worktreeRepository(worktree string) (string, error) {
+	adminDir, err := worktreeAdminDir(worktree)
+	if err != nil {
+		return "", err
+	}
+
+	commonDir, err := ioutil.ReadFile(path.Join(adminDir, "commondir"))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a worktree: %v", worktree, err)
+	}
+
+	gitDir := strings.TrimSpace(string(commonDir))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = path.Join(adminDir, gitDir)
+	}
+
+	return path.Dir(gitDir), nil
+}
+
+// IsWorktreeOf returns true if folder is a worktree of the repository in directory
+func IsWorktreeOf(folder string, directory string) bool {
+	repository, err := worktreeRepository(folder)
+	if err != nil {
+		return false
+	}
+
+	// Git records the real path of the repository, which may be reached through a symlink
+	repository, err1 := filepath.Abs(repository)
+	directory, err2 := filepath.Abs(directory)
+	repository, err3 := filepath.EvalSymlinks(repository)
+	directory, err4 := filepath.EvalSymlinks(directory)
+
+	return err1 == nil && err2 == nil && err3 == nil && err4 == nil && repository == directory
+}
+
+// Worktrees returns the folders of all worktrees registered in the repository,
+// including the ones that do not exist anymore
+func Worktrees(directory string) ([]string, error) {
+	worktrees := make([]string, 0)
+
+	adminDirs, err := ioutil.ReadDir(path.Join(directory, ".git", "worktrees"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return worktrees, nil
+		}
+		return nil, err
+	}
+
+	for _, adminDir := range adminDirs {
+		gitdir, err := ioutil.ReadFile(path.Join(directory, ".git", "worktrees", adminDir.Name(), "gitdir"))
+		if err != nil {
+			continue
+		}
+
+		worktrees = append(worktrees, path.Dir(strings.TrimSpace(string(gitdir))))
+	}
+
+	return worktrees, nil
+}
+
+// isRelativePath returns true if p is a relative path that can not lead to a parent folder
+func isRelativePath(p string) bool {
+	if p == "" || filepath.IsAbs(p) || path.Clean(p) == "." {
+		return false
+	}
+
+	for _, part := range strings.Split(filepath.ToSlash(p), "/") {
+		if part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// submoduleFolder returns the folder of the submodule at submodulePath in the worktree
+// folder, and false if it is not strictly inside of it. Paths are read from .gitmodules,
+// which is part of the repository and can not be trusted: absolute paths, paths containing
+// .., and paths leading through symlinks are refused.
+func submoduleFolder(folder string, submodulePath string) (string, bool) {
+	if !isRelativePath(submodulePath) {
+		return "", false
+	}
+	to := path.Join(folder, submodulePath)
+
+	if fi, err := os.Lstat(to); err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return "", false
+	}
+
+	realFolder, err := filepath.EvalSymlinks(folder)
+	if err != nil {
+		return "", false
+	}
+	realParent, err := filepath.EvalSymlinks(path.Dir(to))
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(realFolder, realParent)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+
+	return to, true
+}
+
+// RemoveWorktree deletes the folder, and if it is a worktree, unregisters it from
+// its repository. Worktrees of submodules are removed first.
+func RemoveWorktree(folder string) error {
+	if _, err := os.Stat(folder); os.IsNotExist(err) {
+		return nil
+	}
+
+	repository, err := worktreeRepository(folder)
+	if err != nil {
+		return os.RemoveAll(folder)
+	}
+
+	if submodules, err := parseGitmodules(path.Join(folder, ".gitmodules")); err == nil {
+		for _, s := range submodules {
+			if submoduleFolder, ok := submoduleFolder(folder, s.path); ok {
+				RemoveWorktree(submoduleFolder)
+			}
+		}
+	}
+
+	if err = backend.WorktreeRemove(repository, folder); err != nil {
+		os.RemoveAll(folder)
+		return err
+	}
+
+	return os.RemoveAll(folder)
+}
+
+// WorktreePrune unregisters all worktrees of the repository that were deleted
+func WorktreePrune(directory string) error { return backend.WorktreePrune(directory) }
+
+// RenameWorktree renames the folder from to to. If it is a worktree, or contains
+// worktrees of submodules, their registration is updated to the new folder.
+func RenameWorktree(from string, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+
+	return RepairWorktree(to)
+}
+
+// RepairWorktree registers the worktree in folder, and the worktrees of its
+// submodules, at their current location, eg after one of its parent folders was renamed
+func RepairWorktree(folder string) error {
+	adminDir, err := worktreeAdminDir(folder)
+	if err != nil {
+		// Not a worktree, eg an exported module
+		return nil
+	}
+
+	abs, err := filepath.Abs(folder)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(path.Join(adminDir, "gitdir"), []byte(path.Join(abs, ".git")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed updating worktree %s: %v", folder, err)
+	}
+
+	if submodules, err := parseGitmodules(path.Join(folder, ".gitmodules")); err == nil {
+		for _, s := range submodules {
+			submoduleFolder, ok := submoduleFolder(folder, s.path)
+			if !ok {
+				continue
+			}
+			if err = RepairWorktree(submoduleFolder); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
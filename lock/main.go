@@ -0,0 +1,124 @@
+package lock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Locks are held with flock on a file next to what they protect, so they are shared
+// by all r10k-go processes, and released when a process exits, even if it crashes.
+// The PID of the process holding an exclusive lock is written to the lock file.
+
+// How long to wait for a lock held by another process
+var timeout = 10 * time.Minute
+
+// How often to check whether a lock was released
+var retryDelay = 100 * time.Millisecond
+
+// SetTimeout sets how long to wait for locks held by other processes
+func SetTimeout(d time.Duration) {
+	timeout = d
+}
+
+// ErrLocked is returned when a lock is still held once the timeout expired
+type ErrLocked struct {
+	File string
+	PID  int // 0 if unknown, eg for shared locks
+}
+
+func (e ErrLocked) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s is locked by another process", e.File)
+	}
+
+	return fmt.Sprintf("%s is locked by process %d", e.File, e.PID)
+}
+
+// Lock is a lock held on a file
+type Lock struct {
+	f         *os.File
+	exclusive bool
+}
+
+// Acquire takes an exclusive lock on file, waiting for other processes to release it
+func Acquire(file string) (*Lock, error) {
+	return acquire(file, syscall.LOCK_EX, timeout)
+}
+
+// AcquireShared takes a lock on file that can be held by several processes at once,
+// but not along with an exclusive lock
+func AcquireShared(file string) (*Lock, error) {
+	return acquire(file, syscall.LOCK_SH, timeout)
+}
+
+// TryAcquire takes an exclusive lock on file, without waiting if it is already held
+func TryAcquire(file string) (*Lock, error) {
+	return acquire(file, syscall.LOCK_EX, 0)
+}
+
+func acquire(file string, how int, wait time.Duration) (*Lock, error) {
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return nil, fmt.Errorf("failed creating lock %s: %v", file, err)
+	}
+
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating lock %s: %v", file, err)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			pid := holder(f)
+			f.Close()
+
+			if err != syscall.EWOULDBLOCK {
+				return nil, fmt.Errorf("failed locking %s: %v", file, err)
+			}
+			return nil, ErrLocked{file, pid}
+		}
+
+		time.Sleep(retryDelay)
+	}
+
+	l := &Lock{f: f, exclusive: how == syscall.LOCK_EX}
+	if l.exclusive {
+		f.Truncate(0)
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+
+	return l, nil
+}
+
+// holder returns the PID written in the lock file
+func holder(f *os.File) int {
+	f.Seek(0, 0)
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0
+	}
+
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+	return pid
+}
+
+// Release releases the lock. The lock file is kept, as other processes may be waiting on it.
+func (l *Lock) Release() error {
+	if l.exclusive {
+		l.f.Truncate(0)
+	}
+
+	defer l.f.Close()
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
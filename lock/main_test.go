@@ -0,0 +1,82 @@
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-lock")
+	if err != nil {
+		t.Fatalf("failed creating temporary folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	SetTimeout(300 * time.Millisecond)
+	file := path.Join(dir, "modules", ".stdlib.r10k-lock")
+
+	l, err := Acquire(file)
+	if err != nil {
+		t.Fatalf("failed acquiring lock: %v", err)
+	}
+
+	// Locks are held on open files, so they also exclude each other within a process
+	start := time.Now()
+	_, err = Acquire(file)
+	if lerr, ok := err.(ErrLocked); !ok || lerr.PID != os.Getpid() {
+		t.Errorf("expected the lock to be held by process %d, got %v", os.Getpid(), err)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Errorf("expected to wait for the lock to be released")
+	}
+
+	if _, err = TryAcquire(file); err == nil {
+		t.Errorf("expected the lock to be held")
+	}
+
+	// The lock is acquired as soon as it is released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l.Release()
+	}()
+
+	l, err = Acquire(file)
+	if err != nil {
+		t.Fatalf("failed acquiring released lock: %v", err)
+	}
+	l.Release()
+}
+
+func TestAcquireShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-lock")
+	if err != nil {
+		t.Fatalf("failed creating temporary folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	SetTimeout(100 * time.Millisecond)
+	file := path.Join(dir, "store.lock")
+
+	l1, err1 := AcquireShared(file)
+	l2, err2 := AcquireShared(file)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("failed acquiring shared locks: %v %v", err1, err2)
+	}
+
+	_, err = Acquire(file)
+	if lerr, ok := err.(ErrLocked); !ok || lerr.PID != 0 {
+		t.Errorf("expected the lock to be held by another process, got %v", err)
+	}
+
+	l1.Release()
+	l2.Release()
+
+	if l, err := TryAcquire(file); err != nil {
+		t.Errorf("failed acquiring released lock: %v", err)
+	} else {
+		l.Release()
+	}
+}
@@ -15,14 +15,17 @@ import (
 	"time"
 
 	"github.com/yannh/r10k-go/git"
+	"github.com/yannh/r10k-go/lock"
 	"github.com/yannh/r10k-go/puppetfileparser"
 	"github.com/yannh/r10k-go/puppetmodule"
 	"github.com/yannh/r10k-go/puppetsource"
+	"github.com/yannh/r10k-go/s3"
 )
 
 type downloadResult struct {
 	err     *puppetmodule.DownloadError
 	skipped bool
+	changes *git.Changes // Set when an existing module was updated
 }
 
 type downloadRequest struct {
@@ -31,14 +34,14 @@ type downloadRequest struct {
 	done chan bool
 }
 
-func installPuppetFiles(puppetFiles []*puppetFile, numWorkers int, cache *cache, withDeps bool, limitToModules ...string) int {
+func installPuppetFiles(puppetFiles []*puppetFile, numWorkers int, cache *cache, withDeps bool, report *deployReport, states *environmentStates, limitToModules ...string) int {
 	drs := make(chan downloadRequest)
 
 	var wg sync.WaitGroup
 	errorCount := make(chan int)
 
 	for w := 1; w <= numWorkers; w++ {
-		go downloadModules(drs, cache, withDeps, &wg, errorCount)
+		go downloadModules(drs, cache, withDeps, report, states, &wg, errorCount)
 	}
 
 	for _, pf := range puppetFiles {
@@ -65,14 +68,12 @@ func installPuppetFiles(puppetFiles []*puppetFile, numWorkers int, cache *cache,
 		nErr += <-errorCount
 	}
 	close(errorCount)
+
+	cache.reportMissing()
 	return nErr
 }
 
-func getPuppetFileForEnvironment(env environment, moduledir string, cache *cache) *puppetFile {
-	if env.fetch(cache) != nil {
-		log.Fatal("Failed fetching environment " + env.branch)
-	}
-
+func getPuppetFileForEnvironment(env environment, moduledir string) *puppetFile {
 	puppetfile := path.Join(env.source.Basedir(), env.branch, "Puppetfile")
 
 	pf := newPuppetFile(puppetfile, environment{env.source, env.branch, moduledir})
@@ -92,30 +93,94 @@ func folderFromModuleName(moduleName string) string {
 	return splitPath[len(splitPath)-1]
 }
 
+// siblingFolder returns a hidden folder next to folder, used while replacing it
+func siblingFolder(folder string, suffix string) string {
+	return path.Join(path.Dir(folder), "."+path.Base(folder)+".r10k-"+suffix)
+}
+
+// replaceFolder moves the folder from to to. An existing folder is moved aside
+// first, and only removed once the new one is in place.
+func replaceFolder(from string, to string) error {
+	old := siblingFolder(to, "old")
+
+	_, err := os.Lstat(to)
+	exists := err == nil
+	if exists {
+		if err = git.RenameWorktree(to, old); err != nil {
+			return fmt.Errorf("failed moving %s aside: %v", to, err)
+		}
+	}
+
+	if err = git.RenameWorktree(from, to); err != nil {
+		if exists {
+			git.RenameWorktree(old, to)
+		}
+		return fmt.Errorf("failed moving %s to %s: %v", from, to, err)
+	}
+
+	if exists {
+		// Worktrees are unregistered from their cache repository, so they do not pile up
+		if err = git.RemoveWorktree(old); err != nil {
+			log.Printf("failed removing %s: %v", old, err)
+		}
+	}
+
+	return nil
+}
+
+// downloadModule downloads the module to a temporary folder next to to, which only
+// replaces the deployed version once complete. If anything fails, the deployed
+// version is kept.
 func downloadModule(m puppetmodule.PuppetModule, to string, cache *cache) downloadResult {
-	if m.IsUpToDate(to) {
+	if m.IsUpToDate(to, cache.folder) {
 		return downloadResult{err: nil, skipped: true}
 	}
 
-	if err := os.RemoveAll(to); err != nil {
-		log.Fatalf("Error removing folder: %s", to)
+	// The deployed version is needed to list what changed
+	deployed := ""
+	cr, reportsChanges := m.(puppetmodule.ChangeReporter)
+	if reportsChanges {
+		deployed = cr.DeployedVersion(to)
+	}
+
+	// Left over by an interrupted deploy
+	tmp := siblingFolder(to, "tmp")
+	for _, folder := range []string{tmp, siblingFolder(to, "old")} {
+		if err := git.RemoveWorktree(folder); err != nil {
+			log.Printf("failed removing %s: %v", folder, err)
+		}
 	}
 
-	if derr := m.Download(to, cache.folder); derr != nil {
+	if derr := m.Download(tmp, cache.folder); derr != nil {
+		if err := git.RemoveWorktree(tmp); err != nil {
+			log.Printf("failed removing %s: %v", tmp, err)
+		}
 		return downloadResult{err: derr, skipped: false}
 	}
 
-	return downloadResult{err: nil, skipped: false}
+	if err := replaceFolder(tmp, to); err != nil {
+		git.RemoveWorktree(tmp)
+		return downloadResult{err: puppetmodule.NewDownloadError(err, false), skipped: false}
+	}
+
+	if deployed == "" {
+		return downloadResult{err: nil, skipped: false}
+	}
+
+	changes, err := cr.Changes(deployed, cache.folder)
+	if err != nil {
+		log.Printf("failed listing changes of %s: %v", m.Name(), err)
+	}
+
+	return downloadResult{err: nil, skipped: false, changes: changes}
 }
 
-func downloadModules(drs chan downloadRequest, cache *cache, downloadDeps bool, wg *sync.WaitGroup, errorsCount chan<- int) {
+func downloadModules(drs chan downloadRequest, cache *cache, downloadDeps bool, report *deployReport, states *environmentStates, wg *sync.WaitGroup, errorsCount chan<- int) {
 	maxTries := 1
 	retryDelay := 5 * time.Second
 	errors := 0
 
 	for dr := range drs {
-		cache.lockModule(dr.m)
-
 		modulesFolder := path.Join(dr.env.source.Basedir(), dr.env.branch, dr.env.modulesFolder)
 		if dr.m.InstallPath() != "" {
 			modulesFolder = path.Join(dr.env.source.Basedir(), dr.env.branch, dr.m.InstallPath())
@@ -123,6 +188,16 @@ func downloadModules(drs chan downloadRequest, cache *cache, downloadDeps bool,
 
 		to := path.Join(modulesFolder, folderFromModuleName(dr.m.Name()))
 
+		// Modules are deployed by a single worker at once, including by other processes
+		l, err := lock.Acquire(siblingFolder(to, "lock"))
+		if err != nil {
+			log.Printf("failed downloading %s to %s: %v. Giving up!\n", dr.m.Name(), to, err)
+			states.fail(dr.env)
+			errors++
+			dr.done <- true
+			continue
+		}
+
 		dres := downloadModule(dr.m, to, cache)
 		for i := 1; dres.err != nil && dres.err.Retryable && i < maxTries; i++ {
 			log.Printf("failed downloading %s: %v... Retrying\n", dr.m.Name(), dres.err)
@@ -131,6 +206,11 @@ func downloadModules(drs chan downloadRequest, cache *cache, downloadDeps bool,
 		}
 
 		if dres.err == nil {
+			states.add(dr.env, to)
+			if c, ok := dr.m.(puppetmodule.Cached); ok {
+				cache.touch(c.CacheEntry())
+			}
+
 			if downloadDeps && !dres.skipped {
 				metadataFilename := path.Join(to, "metadata.json")
 				if mf := newMetadataFile(metadataFilename, dr.env); mf != nil {
@@ -146,21 +226,48 @@ func downloadModules(drs chan downloadRequest, cache *cache, downloadDeps bool,
 				}
 			}
 
-			if !dres.skipped {
+			if _, local := dr.m.(*puppetmodule.LocalModule); local {
+				report.addLocal(dr.m.Name(), to)
+			} else if !dres.skipped {
 				log.Println("Downloaded " + dr.m.Name() + " to " + to)
+				if dres.changes != nil {
+					log.Println(summary(dres.changes))
+				}
+				report.add(dr.m.Name(), to, dres.changes)
 			}
 		} else {
 			log.Printf("failed downloading %s to %s: %v. Giving up!\n", dr.m.Name(), to, dres.err)
+			if dres.err.IsNotCached() {
+				cache.miss(dr.m.Name(), dres.err)
+			}
+			states.fail(dr.env)
 			errors++
 		}
 
 		dr.done <- true
-		cache.unlockModule(dr.m)
+		l.Release()
 	}
 
 	errorsCount <- errors
 }
 
+// newS3Client returns a client for the configured storage, falling back to
+// the usual AWS environment variables
+func newS3Client(c r10kConfigS3) *s3.Client {
+	accessKey, secretKey, sessionToken := c.AccessKeyID, c.SecretAccessKey, ""
+	if accessKey == "" && secretKey == "" {
+		accessKey, secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+		sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	region := c.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+
+	return s3.NewClient(c.Endpoint, region, accessKey, secretKey, sessionToken)
+}
+
 func main() {
 	var err error
 	var numWorkers int
@@ -188,11 +295,80 @@ func main() {
 	}
 	rf.Close()
 
+	gitBackend, err := git.NewBackend(r10kConfig.Git.Provider)
+	if err != nil {
+		log.Fatalf("Error parsing r10k configuration file %s: %v", r10kFile, err)
+	}
+	git.SetBackend(gitBackend)
+	git.SetDefaultCloneOptions(git.CloneOptions{Depth: r10kConfig.Git.Depth, Filter: r10kConfig.Git.Filter})
+	if err = git.SetURLRewrites(r10kConfig.Git.Rewrites); err != nil {
+		log.Fatalf("Error parsing r10k configuration file %s: %v", r10kFile, err)
+	}
+	if err = git.SetMirrors(r10kConfig.Git.Mirrors); err != nil {
+		log.Fatalf("Error parsing r10k configuration file %s: %v", r10kFile, err)
+	}
+	if err = puppetmodule.SetDefaultGitDeploy(r10kConfig.Git.Deploy); err != nil {
+		log.Fatalf("Error parsing r10k configuration file %s: %v", r10kFile, err)
+	}
+	puppetmodule.SetSignatureVerification(r10kConfig.Git.VerifySignatures, r10kConfig.Git.Keyring)
+
+	githubToken := r10kConfig.Github.Token
+	if githubToken == "" {
+		githubToken = os.Getenv("GITHUB_TOKEN")
+	}
+	puppetmodule.SetGithubConfig(r10kConfig.Github.APIURL, githubToken)
+
+	gitlabToken := r10kConfig.Gitlab.Token
+	if gitlabToken == "" {
+		gitlabToken = os.Getenv("GITLAB_TOKEN")
+	}
+	puppetmodule.SetGitlabConfig(r10kConfig.Gitlab.URL, gitlabToken)
+
+	bitbucketToken := r10kConfig.Bitbucket.Token
+	if bitbucketToken == "" {
+		bitbucketToken = os.Getenv("BITBUCKET_TOKEN")
+	}
+	puppetmodule.SetBitbucketConfig(r10kConfig.Bitbucket.APIURL, r10kConfig.Bitbucket.URL, bitbucketToken)
+
+	s3Client := newS3Client(r10kConfig.S3)
+	puppetmodule.SetS3Client(s3Client)
+	if r10kConfig.S3.Cache != "" {
+		archiveCache, err := s3.NewCache(s3Client, r10kConfig.S3.Cache)
+		if err != nil {
+			log.Fatalf("Error parsing r10k configuration file %s: %v", r10kFile, err)
+		}
+		puppetmodule.SetArchiveCache(archiveCache)
+	}
+
+	if err = puppetmodule.SetStore(r10kConfig.Store); err != nil {
+		log.Fatalf("Error parsing r10k configuration file %s: %v", r10kFile, err)
+	}
+
+	// Nothing is downloaded, modules and environments are deployed from the cache
+	offline := r10kConfig.Offline || cliOpts["--offline"] == true
+	git.SetOffline(offline)
+	puppetmodule.SetOffline(offline)
+
 	cacheDir := ".cache"
 	if r10kConfig.Cachedir != "" {
 		cacheDir = r10kConfig.Cachedir
 	}
 
+	if r10kConfig.LockTimeout != "" {
+		lockTimeout, err := time.ParseDuration(r10kConfig.LockTimeout)
+		if err != nil {
+			log.Fatalf("Error parsing r10k configuration file %s: %v", r10kFile, err)
+		}
+		lock.SetTimeout(lockTimeout)
+	}
+
+	var maxCacheSize int64
+	if r10kConfig.CacheMaxSize != "" {
+		if maxCacheSize, err = parseSize(r10kConfig.CacheMaxSize); err != nil {
+			log.Fatalf("Error parsing r10k configuration file %s: %v", r10kFile, err)
+		}
+	}
+
 	if cliOpts["check"] != false {
 		puppetfile := "./Puppetfile"
 		if cliOpts["--puppetfile"] != nil {
@@ -221,6 +397,43 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if cliOpts["cache"] == true && cliOpts["list"] == true {
+		os.Exit(listCache(cache, r10kConfig.Sources))
+	}
+
+	if cliOpts["cache"] == true && cliOpts["verify"] == true {
+		os.Exit(verifyCache(cache))
+	}
+
+	if cliOpts["cache"] == true && cliOpts["prune"] == true {
+		var olderThan time.Duration
+		if cliOpts["--older-than"] != nil {
+			if olderThan, err = parseAge(cliOpts["--older-than"].(string)); err != nil {
+				log.Fatalf("Parameter --older-than: %v", err)
+			}
+		}
+
+		maxSize := int64(0)
+		if cliOpts["--max-size"] != nil {
+			if maxSize, err = parseSize(cliOpts["--max-size"].(string)); err != nil {
+				log.Fatalf("Parameter --max-size: %v", err)
+			}
+		}
+
+		os.Exit(pruneCache(cache, r10kConfig.Sources, olderThan, maxSize))
+	}
+
+	report := newDeployReport()
+	states := newEnvironmentStates(cache)
+	writeReport := func() {
+		if cliOpts["--report"] == nil {
+			return
+		}
+		if err := report.write(cliOpts["--report"].(string)); err != nil {
+			log.Printf("failed writing report: %v", err)
+		}
+	}
+
 	if cliOpts["install"] == true {
 		puppetfile := ""
 		if cliOpts["--puppetfile"] == nil {
@@ -240,7 +453,12 @@ func main() {
 		}
 
 		puppetFiles = append(puppetFiles, pf)
-		os.Exit(installPuppetFiles(puppetFiles, 4, cache, !cliOpts["--no-deps"].(bool)))
+		nErr := installPuppetFiles(puppetFiles, 4, cache, !cliOpts["--no-deps"].(bool), report, states)
+		cache.pruneWorktrees()
+		cache.pruneStore()
+		cache.limitSize(r10kConfig.Sources, maxCacheSize)
+		writeReport()
+		os.Exit(nErr)
 	}
 
 	if cliOpts["deploy"] == true && cliOpts["environment"] == true {
@@ -249,18 +467,64 @@ func main() {
 			moduledir = cliOpts["--moduledir"].(string)
 		}
 
+		// Offline, environments are the branches of the cached sources
+		if offline {
+			for _, s := range r10kConfig.Sources {
+				if err := s.Fetch(cache.folder); err != nil {
+					log.Fatalf("Failed fetching source %s: %v", s.Name(), err)
+				}
+			}
+		}
+
 		envs := getEnvironments(cliOpts["<env>"].([]string), r10kConfig.Sources)
 		puppetFiles := make([]*puppetFile, 0)
+		deployed := make([]environment, 0)
+		commits := make(map[string]string)
+		envLocks := make([]*lock.Lock, 0)
 		for _, env := range envs {
-			puppetFiles = append(puppetFiles, getPuppetFileForEnvironment(env, moduledir, cache))
+			env.modulesFolder = moduledir
+
+			// Held until the environment and its modules are deployed
+			l, err := lock.Acquire(siblingFolder(path.Join(env.source.Basedir(), env.branch), "lock"))
+			if err != nil {
+				log.Fatalf("Failed locking environment %s: %v", env.branch, err)
+			}
+			envLocks = append(envLocks, l)
+
+			if err := env.fetch(cache); err != nil {
+				log.Fatalf("Failed fetching environment %s: %v", env.branch, err)
+			}
+
+			// Environments are skipped when neither the control repository nor their modules changed
+			commits[envKey(env)] = env.commit()
+			pf := getPuppetFileForEnvironment(env, moduledir)
+			if states.skip(env, pf, commits[envKey(env)], cliOpts["--force"] == true) {
+				log.Printf("Environment %s is up to date, skipping", env.branch)
+				pf.Close()
+				continue
+			}
+
+			puppetFiles = append(puppetFiles, pf)
+			deployed = append(deployed, env)
 		}
 
-		os.Exit(installPuppetFiles(puppetFiles, 4, cache, !cliOpts["--no-deps"].(bool)))
+		nErr := installPuppetFiles(puppetFiles, 4, cache, !cliOpts["--no-deps"].(bool), report, states)
+		if err := states.save(deployed, commits); err != nil {
+			log.Printf("failed saving the state of environments: %v", err)
+		}
+		for _, l := range envLocks {
+			l.Release()
+		}
+		cache.pruneWorktrees()
+		cache.pruneStore()
+		cache.limitSize(r10kConfig.Sources, maxCacheSize)
+		writeReport()
+		os.Exit(nErr)
 	}
 
 	if cliOpts["deploy"] == true && cliOpts["module"] == true {
 		for _, s := range r10kConfig.Sources { // TODO verify sourceName is usable as a directory name
-			git.Fetch(path.Join(cache.folder, s.Remote()))
+			s.Fetch(cache.folder)
 
 			for _, env := range DeployedEnvironments(s) {
 				if pf := newPuppetFile(path.Join(s.Basedir(), env.branch, "Puppetfile"), env); pf != nil {
@@ -270,7 +534,12 @@ func main() {
 		}
 
 		limit := cliOpts["<module>"].([]string)
-		os.Exit(installPuppetFiles(puppetFiles, numWorkers, cache, false, limit...))
+		nErr := installPuppetFiles(puppetFiles, numWorkers, cache, false, report, states, limit...)
+		cache.pruneWorktrees()
+		cache.pruneStore()
+		cache.limitSize(r10kConfig.Sources, maxCacheSize)
+		writeReport()
+		os.Exit(nErr)
 	}
 
 	os.Exit(1)
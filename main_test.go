@@ -0,0 +1,260 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yannh/r10k-go/lock"
+	"github.com/yannh/r10k-go/puppetmodule"
+	"github.com/yannh/r10k-go/puppetsource"
+)
+
+func TestEnvironmentSkip(t *testing.T) {
+	const pinned = `
+mod 'puppetlabs-stdlib', '4.25.0'
+mod 'puppetlabs-apache',
+  :git => 'https://github.com/puppetlabs/puppetlabs-apache.git',
+  :tag => 'v1.0.0'
+mod 'puppetlabs-ntp',
+  :git => 'https://github.com/puppetlabs/puppetlabs-ntp.git',
+  :ref => '4a1ab2ae890b049e3757fda320427ef018167096'
+mod 'vendor-foo',
+  :tarball => 'https://example.com/vendor-foo-1.2.3.tar.gz',
+  :sha256 => '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08'
+mod 'site',
+  :local => true
+`
+
+	testCases := []struct {
+		name       string
+		puppetfile string
+		commit     string // Commit of the control repository when deployed again
+		force      bool
+		modified   bool // A deployed module was updated since
+		skipped    bool
+	}{
+		{"unchanged", pinned, "c1", false, false, true},
+		{"forced", pinned, "c1", true, false, false},
+		{"control repository updated", pinned, "c2", false, false, false},
+		{"module modified", pinned, "c1", false, true, false},
+		{"branch", "mod 'puppetlabs-apache',\n  :git => 'https://github.com/puppetlabs/puppetlabs-apache.git',\n  :branch => 'main'\n", "c1", false, false, false},
+		{"default branch", "mod 'puppetlabs-apache',\n  :git => 'https://github.com/puppetlabs/puppetlabs-apache.git'\n", "c1", false, false, false},
+		{"latest Forge version", "mod 'puppetlabs-stdlib', :latest\n", "c1", false, false, false},
+		{"latest GitHub tag", "mod 'puppetlabs-apache',\n  :github_tarball => 'puppetlabs/puppetlabs-apache'\n", "c1", false, false, false},
+		{"tarball without checksum", "mod 'vendor-foo',\n  :tarball => 'https://example.com/vendor-foo.tar.gz'\n", "c1", false, false, false},
+	}
+
+	for _, c := range testCases {
+		dir, err := ioutil.TempDir("", "r10k-states")
+		if err != nil {
+			t.Fatalf("failed creating temporary folder: %v", err)
+		}
+
+		env := environment{puppetsource.NewGitSource("", "", path.Join(dir, "environments"), "", ""), "production", "modules"}
+		module := path.Join(dir, "environments", "production", "modules", "apache")
+		os.MkdirAll(module, 0755)
+		ioutil.WriteFile(path.Join(module, ".commit"), []byte("m1"), 0644)
+
+		puppetfile := path.Join(dir, "environments", "production", "Puppetfile")
+		ioutil.WriteFile(puppetfile, []byte(c.puppetfile), 0644)
+
+		states := newEnvironmentStates(&cache{folder: path.Join(dir, "cache")})
+		states.add(env, module)
+		if err = states.save([]environment{env}, map[string]string{envKey(env): "c1"}); err != nil {
+			t.Fatalf("%s: failed saving the state of the environment: %v", c.name, err)
+		}
+
+		if c.modified {
+			ioutil.WriteFile(path.Join(module, ".commit"), []byte("m2"), 0644)
+		}
+
+		// The Puppetfile is read again when the environment is deployed
+		pf := newPuppetFile(puppetfile, env)
+		for i := 0; i < 2; i++ {
+			if skipped := states.skip(env, pf, c.commit, c.force); skipped != c.skipped {
+				t.Errorf("%s: expected the environment to be skipped: %v, got %v", c.name, c.skipped, skipped)
+			}
+		}
+		pf.Close()
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEnvironmentSkipFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-states")
+	if err != nil {
+		t.Fatalf("failed creating temporary folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := environment{puppetsource.NewGitSource("", "", path.Join(dir, "environments"), "", ""), "production", "modules"}
+	puppetfile := path.Join(dir, "environments", "production", "Puppetfile")
+	os.MkdirAll(path.Dir(puppetfile), 0755)
+	ioutil.WriteFile(puppetfile, []byte("mod 'puppetlabs-stdlib', '4.25.0'\n"), 0644)
+
+	// Environments are only recorded when all their modules were deployed
+	states := newEnvironmentStates(&cache{folder: path.Join(dir, "cache")})
+	states.fail(env)
+	if err = states.save([]environment{env}, map[string]string{envKey(env): "c1"}); err != nil {
+		t.Fatalf("failed saving the state of the environment: %v", err)
+	}
+
+	pf := newPuppetFile(puppetfile, env)
+	defer pf.Close()
+	if states.skip(env, pf, "c1", false) {
+		t.Errorf("expected an environment that failed deploying not to be skipped")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	testCases := []struct {
+		s        string
+		expected int64
+		valid    bool
+	}{
+		{"512", 512, true},
+		{"512B", 512, true},
+		{"1K", 1 << 10, true},
+		{"512M", 512 << 20, true},
+		{"512mb", 512 << 20, true},
+		{" 10G ", 10 << 30, true},
+		{"1.5G", 3 << 29, true},
+		{"2T", 2 << 40, true},
+		{"", 0, false},
+		{"G", 0, false},
+		{"10X", 0, false},
+		{"-1G", 0, false},
+		{"1.2.3M", 0, false},
+	}
+
+	for _, c := range testCases {
+		size, err := parseSize(c.s)
+		if (err == nil) != c.valid {
+			t.Errorf("unexpected result parsing %s: %v", c.s, err)
+		}
+		if size != c.expected {
+			t.Errorf("expected %s to be parsed as %d, got %d", c.s, c.expected, size)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	testCases := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1 << 10, "1.0K"},
+		{3 << 29, "1.5G"},
+		{2 << 40, "2.0T"},
+	}
+
+	for _, c := range testCases {
+		if actual := formatSize(c.size); actual != c.expected {
+			t.Errorf("expected %d to be formatted as %s, got %s", c.size, c.expected, actual)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	testCases := []struct {
+		s        string
+		expected time.Duration
+		valid    bool
+	}{
+		{"12h", 12 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"30d", 30 * 24 * time.Hour, true},
+		{"0d", 0, true},
+		{"-1d", 0, false},
+		{"d", 0, false},
+		{"1.5d", 0, false},
+		{"12", 0, false},
+		{"", 0, false},
+	}
+
+	for _, c := range testCases {
+		age, err := parseAge(c.s)
+		if (err == nil) != c.valid {
+			t.Errorf("unexpected result parsing %s: %v", c.s, err)
+		}
+		if age != c.expected {
+			t.Errorf("expected %s to be parsed as %s, got %s", c.s, c.expected, age)
+		}
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-cache")
+	if err != nil {
+		t.Fatalf("failed creating temporary folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newCache(path.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An environment deployed from a Puppetfile using a tarball module
+	basedir := path.Join(dir, "environments")
+	url := "https://example.com/vendor-foo-1.2.3.tar.gz"
+	os.MkdirAll(path.Join(basedir, "production"), 0755)
+	ioutil.WriteFile(path.Join(basedir, "production", "Puppetfile"), []byte("mod 'vendor-foo',\n  :tarball => '"+url+"'\n"), 0644)
+	sources := []puppetsource.Source{puppetsource.NewGitSource("control", "", basedir, "", "")}
+
+	// Entries of 1K, the least recently used first: used ones are not removed however old
+	used := puppetmodule.NewTarballModule("vendor-foo", url, "", "").CacheEntry()
+	names := []string{used, "locked", "unused-1", "unused-2", "unused-3"}
+	for i, name := range names {
+		folder := path.Join(c.folder, name)
+		os.MkdirAll(folder, 0755)
+		ioutil.WriteFile(path.Join(folder, "archive.tar.gz"), []byte(strings.Repeat("x", 1<<10)), 0644)
+
+		lastUsed := time.Now().Add(time.Duration(i-len(names)) * time.Hour)
+		os.Chtimes(folder, lastUsed, lastUsed)
+	}
+
+	// Entries being updated by a deploy are locked
+	l, err := lock.Acquire(path.Join(c.folder, "locked") + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Release()
+
+	usedEntries := c.usedEntries(sources)
+	if len(usedEntries[used]) != 1 || usedEntries[used][0] != "production/vendor-foo" {
+		t.Errorf("expected %s to be used by production/vendor-foo, got %v", used, usedEntries[used])
+	}
+
+	// The cache is 5K, the 2 oldest unused entries are removed to bring it to 3K
+	removed, err := c.prune(usedEntries, 0, c.size()-2<<10)
+	if err != nil {
+		t.Fatalf("failed pruning the cache: %v", err)
+	}
+
+	if len(removed) != 2 || removed[0].name != "unused-1" || removed[1].name != "unused-2" {
+		t.Errorf("expected the 2 oldest unused entries to be removed, got %+v", removed)
+	}
+
+	for name, kept := range map[string]bool{used: true, "locked": true, "unused-1": false, "unused-2": false, "unused-3": true} {
+		if _, err := os.Stat(path.Join(c.folder, name)); (err == nil) != kept {
+			t.Errorf("expected %s to be kept: %v", name, kept)
+		}
+	}
+
+	// Entries used recently are kept
+	if removed, err = c.prune(usedEntries, 2*time.Hour, 0); err != nil || len(removed) != 0 {
+		t.Errorf("expected entries used recently to be kept, got %+v %v", removed, err)
+	}
+
+	if removed, err = c.prune(usedEntries, 0, 0); err != nil || len(removed) != 1 || removed[0].name != "unused-3" {
+		t.Errorf("expected the last unused entry to be removed, got %+v %v", removed, err)
+	}
+}
@@ -52,7 +52,7 @@ func (m *metadataFile) Process(drs chan<- downloadRequest) error {
 
 	for _, req := range meta.dependencies {
 		dr := downloadRequest{
-			m:    puppetmodule.NewForgeModule(req.name, ""),
+			m:    puppetmodule.NewForgeModule(req.name, "", ""),
 			env:  m.env,
 			done: done,
 		}
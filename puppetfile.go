@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"io"
 	"os"
+	"strconv"
 
 	"github.com/yannh/r10k-go/git"
 	"github.com/yannh/r10k-go/puppetfileparser"
@@ -13,6 +15,7 @@ type puppetFile struct {
 	*os.File // Make that a io.Reader
 	filename string
 	env      environment
+	forge    string // Set by the forge option of the Puppetfile, once parsed
 }
 
 func newPuppetFile(pf string, env environment) *puppetFile {
@@ -38,11 +41,21 @@ func (p *puppetFile) toTypedModule(module map[string]string) puppetmodule.Puppet
 			ref = git.NewRef(git.TypeRef, module["branch"])
 		}
 
+		// Parameters are validated by the parser
+		depth, _ := strconv.Atoi(module["depth"])
+
 		return puppetmodule.NewGitModule(
 			module["name"],
 			module["repoUrl"],
 			module["installPath"],
 			ref,
+			puppetmodule.GitModuleOptions{
+				Clone:  git.CloneOptions{Depth: depth, Filter: module["filter"]},
+				Path:   module["path"],
+				Deploy: module["deploy"],
+
+				VerifySignatures: module["verify_signatures"],
+			},
 		)
 
 	case "github_tarball":
@@ -53,22 +66,76 @@ func (p *puppetFile) toTypedModule(module map[string]string) puppetmodule.Puppet
 			"",
 		)
 
+	case "gitlab_tarball":
+		return puppetmodule.NewGitlabTarballModule(
+			module["name"],
+			module["repoName"],
+			module["version"],
+			"",
+		)
+
+	case "bitbucket_tarball":
+		return puppetmodule.NewBitbucketTarballModule(
+			module["name"],
+			module["repoName"],
+			module["version"],
+			"",
+		)
+
+	case "tarball":
+		return puppetmodule.NewTarballModule(
+			module["name"],
+			module["url"],
+			module["sha256"],
+			module["installPath"],
+		)
+
+	case "s3":
+		return puppetmodule.NewS3Module(
+			module["name"],
+			module["url"],
+			module["sha256"],
+			module["installPath"],
+		)
+
+	case "local":
+		return puppetmodule.NewLocalModule(module["name"])
+
 	default:
-		return puppetmodule.NewForgeModule(module["name"], module["version"])
+		return puppetmodule.NewForgeModule(module["name"], module["version"], p.forge)
 	}
 }
 
 func (p *puppetFile) Close() { p.File.Close() }
 
+// hasFloatingModules returns true if a module of the Puppetfile is not pinned to a
+// version, or if the Puppetfile can not be parsed
+func (p *puppetFile) hasFloatingModules() bool {
+	parsedModules, opts, err := puppetfileparser.Parse(bufio.NewScanner(p.File))
+	if _, serr := p.File.Seek(0, io.SeekStart); err != nil || serr != nil {
+		return true
+	}
+	p.forge = opts["forge"]
+
+	for _, module := range parsedModules {
+		if f, ok := p.toTypedModule(module).(puppetmodule.Floating); !ok || f.Floating() {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Will download all modules in the Puppetfile
 // limitToModules is a list of module names - if set, only those will be downloaded
 func (p *puppetFile) Process(drs chan<- downloadRequest, limitToModules ...string) error {
 	done := make(chan bool)
 
-	parsedModules, _, err := puppetfileparser.Parse(bufio.NewScanner(p.File))
+	parsedModules, opts, err := puppetfileparser.Parse(bufio.NewScanner(p.File))
 	if err != nil {
 		return puppetfileparser.ErrMalformedPuppetfile{S: err.Error()}
 	}
+	p.forge = opts["forge"]
 
 	nDownloadRequests := 0
 	for _, module := range parsedModules {
@@ -2,7 +2,9 @@ package puppetfileparser
 
 import (
 	"bufio"
+	"encoding/hex"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -10,7 +12,7 @@ type ErrMalformedPuppetfile struct{ S string }
 
 func (e ErrMalformedPuppetfile) Error() string { return e.S }
 func NewErrMalformedPuppetfile(s string, params ...interface{}) error {
-	return ErrMalformedPuppetfile{S: fmt.Sprintf(s, params)}
+	return ErrMalformedPuppetfile{S: fmt.Sprintf(s, params...)}
 }
 
 func parseParameter(line string) string {
@@ -56,10 +58,41 @@ func parseModule(line string) (map[string]string, error) {
 			module["type"] = "github_tarball"
 			module["repoName"] = parseParameter(part)
 
+		case strings.HasPrefix(part, ":gitlab_tarball"):
+			module["type"] = "gitlab_tarball"
+			module["repoName"] = parseParameter(part)
+
+		case strings.HasPrefix(part, ":bitbucket_tarball"):
+			module["type"] = "bitbucket_tarball"
+			module["repoName"] = parseParameter(part)
+
+		case strings.HasPrefix(part, ":tarball"):
+			module["type"] = "tarball"
+			module["url"] = parseParameter(part)
+
+		case strings.HasPrefix(part, ":s3"):
+			module["type"] = "s3"
+			module["url"] = parseParameter(part)
+			if !strings.HasPrefix(module["url"], "s3://") {
+				return nil, NewErrMalformedPuppetfile("s3 should be an s3:// URL, got %s", module["url"])
+			}
+
+		case strings.HasPrefix(part, ":sha256"):
+			module["sha256"] = parseParameter(part)
+			if _, err := hex.DecodeString(module["sha256"]); err != nil || len(module["sha256"]) != 64 {
+				return nil, NewErrMalformedPuppetfile("sha256 should be a SHA256 checksum, got %s", module["sha256"])
+			}
+
 		case strings.HasPrefix(part, ":git"):
 			module["type"] = "git"
 			module["repoUrl"] = parseParameter(part)
 
+		case strings.HasPrefix(part, ":local"):
+			if parseParameter(part) != "true" {
+				return nil, NewErrMalformedPuppetfile("local should be true, got %s", parseParameter(part))
+			}
+			module["type"] = "local"
+
 		case strings.HasPrefix(part, ":install_path"):
 			module["installPath"] = parseParameter(part)
 
@@ -72,6 +105,30 @@ func parseModule(line string) (map[string]string, error) {
 		case strings.HasPrefix(part, ":branch"):
 			module["branch"] = parseParameter(part)
 
+		case strings.HasPrefix(part, ":depth"):
+			module["depth"] = parseParameter(part)
+			if depth, err := strconv.Atoi(module["depth"]); err != nil || depth < 1 {
+				return nil, NewErrMalformedPuppetfile("depth should be a positive integer, got %s", module["depth"])
+			}
+
+		case strings.HasPrefix(part, ":filter"):
+			module["filter"] = parseParameter(part)
+
+		case strings.HasPrefix(part, ":path"):
+			module["path"] = parseParameter(part)
+
+		case strings.HasPrefix(part, ":deploy"):
+			module["deploy"] = parseParameter(part)
+			if module["deploy"] != "worktree" && module["deploy"] != "export" {
+				return nil, NewErrMalformedPuppetfile("deploy should be worktree or export, got %s", module["deploy"])
+			}
+
+		case strings.HasPrefix(part, ":verify_signatures"):
+			module["verify_signatures"] = parseParameter(part)
+			if module["verify_signatures"] != "true" && module["verify_signatures"] != "false" {
+				return nil, NewErrMalformedPuppetfile("verify_signatures should be true or false, got %s", module["verify_signatures"])
+			}
+
 		default:
 			return nil, NewErrMalformedPuppetfile("unsupported parameter %s", part)
 		}
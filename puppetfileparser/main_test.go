@@ -74,6 +74,50 @@ mod 'puppetlabs-stdlib',
 					{"name": "puppetlabs-stdlib", "repoUrl": "git://github.com/puppetlabs/puppetlabs-stdlib.git"},
 				},
 			},
+		}, {
+			puppetfile: `
+mod 'site',
+  :local => true
+
+mod 'vendor-foo',
+  :tarball => 'https://example.com/vendor-foo-1.2.3.tar.gz',
+  :sha256 => '9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08'
+
+mod 'puppetlabs-stdlib',
+  :git => "git://github.com/puppetlabs/puppetlabs-stdlib.git",
+  :depth => 1,
+  :filter => 'blob:none',
+  :path => 'modules/stdlib',
+  :deploy => 'export',
+  :verify_signatures => true
+      `,
+			result: expected{
+				opts: map[string]string{},
+				modules: []map[string]string{
+					{"name": "site", "type": "local"},
+					{"name": "vendor-foo", "type": "tarball", "url": "https://example.com/vendor-foo-1.2.3.tar.gz", "sha256": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+					{"name": "puppetlabs-stdlib", "repoUrl": "git://github.com/puppetlabs/puppetlabs-stdlib.git", "depth": "1", "filter": "blob:none", "path": "modules/stdlib", "deploy": "export", "verify_signatures": "true"},
+				},
+			},
+		}, {
+			puppetfile: `
+mod 'vendor-foo', '1.2.3',
+  :gitlab_tarball => 'infra/puppet/vendor-foo'
+
+mod 'vendor-bar',
+  :bitbucket_tarball => 'vendor/puppet-bar'
+
+mod 'vendor-baz',
+  :s3 => 's3://puppet-modules/vendor-baz-2.0.0.tar.gz'
+      `,
+			result: expected{
+				opts: map[string]string{},
+				modules: []map[string]string{
+					{"name": "vendor-foo", "type": "gitlab_tarball", "version": "1.2.3", "repoName": "infra/puppet/vendor-foo"},
+					{"name": "vendor-bar", "type": "bitbucket_tarball", "repoName": "vendor/puppet-bar"},
+					{"name": "vendor-baz", "type": "s3", "url": "s3://puppet-modules/vendor-baz-2.0.0.tar.gz"},
+				},
+			},
 		},
 	}
 
@@ -128,6 +172,29 @@ mod 'puppetlabs-stdlib'
 
 		// Missing comma
 		`mod "ntp" "1.0.3"`,
+
+		// Invalid depth
+		`mod 'puppetlabs-stdlib',
+ :git => "git://github.com/puppetlabs/puppetlabs-stdlib.git",
+ :depth => "all"`,
+
+		// Invalid checksum
+		`mod 'vendor-foo',
+ :tarball => 'https://example.com/vendor-foo-1.2.3.tar.gz',
+ :sha256 => 'abc'`,
+
+		// s3 modules need an s3:// URL
+		`mod 'vendor-baz',
+ :s3 => 'https://example.com/vendor-baz-2.0.0.tar.gz'`,
+
+		// Invalid local parameter
+		`mod 'site',
+ :local => "yes"`,
+
+		// Invalid deploy mode
+		`mod 'puppetlabs-stdlib',
+ :git => "git://github.com/puppetlabs/puppetlabs-stdlib.git",
+ :deploy => "copy"`,
 	}
 
 	for _, c := range testCases {
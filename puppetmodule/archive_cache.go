@@ -0,0 +1,161 @@
+package puppetmodule
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yannh/r10k-go/archive"
+	"github.com/yannh/r10k-go/sidecar"
+)
+
+// ArchiveCache shares downloaded archives, eg between deploy servers. Archives
+// are named after their path in the local cache.
+type ArchiveCache interface {
+	Get(name string, to string) error
+	Put(name string, from string) error
+}
+
+var archiveCache ArchiveCache
+
+// SetArchiveCache sets where archives are retrieved from before being downloaded,
+// and stored after
+func SetArchiveCache(c ArchiveCache) {
+	archiveCache = c
+}
+
+// fetchArchive makes sure cacheFile exists, retrieving it from the archive cache if
+// one is configured, or downloading it from source. valid, if set, discards invalid
+// archives. Downloaded archives are only added to the archive cache if valid and
+// not corrupted.
+func fetchArchive(cache string, cacheFile string, source string, valid func(string) bool, download func() *DownloadError) *DownloadError {
+	if valid == nil {
+		valid = func(string) bool { return true }
+	}
+
+	if _, err := os.Stat(cacheFile); err == nil && valid(cacheFile) {
+		return nil
+	}
+
+	if offline {
+		return notCached("%s", source)
+	}
+	os.Remove(cacheFile)
+
+	name, err := filepath.Rel(cache, cacheFile)
+	if err != nil || archiveCache == nil {
+		if derr := download(); derr != nil {
+			return derr
+		}
+		return recordArchive(cache, cacheFile, source)
+	}
+
+	if err = archiveCache.Get(name, cacheFile); err == nil {
+		if valid(cacheFile) {
+			return recordArchive(cache, cacheFile, source)
+		}
+		os.Remove(cacheFile)
+	}
+
+	if derr := download(); derr != nil {
+		return derr
+	}
+
+	if derr := recordArchive(cache, cacheFile, source); derr != nil {
+		return derr
+	}
+
+	if valid(cacheFile) {
+		if err = VerifyArchive(cacheFile, ""); err != nil {
+			fmt.Printf("Not adding %s to the archive cache: %v\n", name, err)
+		} else if err = archiveCache.Put(name, cacheFile); err != nil {
+			fmt.Printf("Failed adding %s to the archive cache: %v\n", name, err)
+		}
+	}
+
+	return nil
+}
+
+// VerifyArchive returns an error if the archive filename is truncated or corrupted,
+// or if checksum is set and does not match it
+func VerifyArchive(filename string, checksum string) error {
+	if checksum != "" {
+		actual, err := sidecar.Checksum(filename)
+		if err != nil {
+			return err
+		}
+		if actual != checksum {
+			return fmt.Errorf("checksum is %s, expected %s", actual, checksum)
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return archive.Verify(f)
+}
+
+// recordArchive records the source and checksum of an archive in the description
+// of its cache entry
+func recordArchive(cache string, cacheFile string, source string) *DownloadError {
+	entry, _ := filepath.Rel(cache, path.Dir(cacheFile))
+	if err := sidecar.Record(cache, entry, source, cacheFile); err != nil {
+		return &DownloadError{fmt.Errorf("failed recording %s: %v", cacheFile, err), false}
+	}
+
+	return nil
+}
+
+// latestCachedVersion returns the version of the archive of cacheFolder fetched last, or
+// an empty string if there is none. Used offline, when the latest version can not be looked up.
+func latestCachedVersion(cacheFolder string) string {
+	archives, err := ioutil.ReadDir(cacheFolder)
+	if err != nil {
+		return ""
+	}
+
+	version := ""
+	var fetchedAt time.Time
+	for _, a := range archives {
+		if !a.Mode().IsRegular() || !strings.HasSuffix(a.Name(), ".tar.gz") {
+			continue
+		}
+
+		if version == "" || a.ModTime().After(fetchedAt) {
+			version = strings.TrimSuffix(a.Name(), ".tar.gz")
+			fetchedAt = a.ModTime()
+		}
+	}
+
+	return version
+}
+
+// migrateArchive moves an archive cached by a previous version of r10k-go, whose
+// cache entries were named differently, to cacheFile
+func migrateArchive(cache string, oldFile string, cacheFile string, source string) {
+	if _, err := os.Stat(cacheFile); err == nil {
+		return
+	}
+	if _, err := os.Stat(oldFile); err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(path.Dir(cacheFile), 0755); err != nil {
+		return
+	}
+	if err := os.Rename(oldFile, cacheFile); err != nil {
+		return
+	}
+
+	// Fails as long as other archives are left in the old entry
+	os.Remove(path.Dir(oldFile))
+
+	recordArchive(cache, cacheFile, source)
+}
@@ -0,0 +1,141 @@
+package puppetmodule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// BitbucketTarballModule is deployed from the archive of a tag of a Bitbucket repository
+type BitbucketTarballModule struct {
+	name        string
+	repoName    string // eg workspace/repository
+	version     string
+	commit      string // Commit of the tag, once resolved
+	installPath string
+}
+
+type bbTags struct {
+	Values []struct {
+		Name   string
+		Target struct {
+			Hash string
+		}
+	}
+	Next string
+}
+
+var bitbucketAPIURL = "https://api.bitbucket.org/2.0"
+var bitbucketURL = "https://bitbucket.org"
+var bitbucket = &releaseAPI{name: "Bitbucket", header: http.Header{}}
+
+// SetBitbucketConfig sets the URL of the Bitbucket API, the URL archives are downloaded
+// from, and the access token used to authenticate
+func SetBitbucketConfig(apiURL, baseURL, token string) {
+	if apiURL != "" {
+		bitbucketAPIURL = strings.TrimSuffix(apiURL, "/")
+	}
+	if baseURL != "" {
+		bitbucketURL = strings.TrimSuffix(baseURL, "/")
+	}
+
+	bitbucket.header.Del("Authorization")
+	if token != "" {
+		bitbucket.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func NewBitbucketTarballModule(name, repoName, version, installPath string) *BitbucketTarballModule {
+	return &BitbucketTarballModule{
+		name:        name,
+		repoName:    strings.Trim(repoName, "/"),
+		version:     version,
+		installPath: installPath,
+	}
+}
+
+func (m *BitbucketTarballModule) Name() string        { return m.name }
+func (m *BitbucketTarballModule) InstallPath() string { return m.installPath }
+
+func (m *BitbucketTarballModule) hash() string {
+	return cacheKey("bitbucket", bitbucketURL, m.repoName)
+}
+
+func (m *BitbucketTarballModule) CacheEntry() string {
+	return m.hash()
+}
+
+// Floating returns true if no version is specified, as the latest tag is deployed
+func (m *BitbucketTarballModule) Floating() bool {
+	return m.version == ""
+}
+
+func (m *BitbucketTarballModule) IsUpToDate(folder string, cache string) bool {
+	return releaseIsUpToDate(folder, m.version)
+}
+
+// resolveVersion sets the version to the latest tag if none was specified, or checks
+// that the tag exists
+func (m *BitbucketTarballModule) resolveVersion() *DownloadError {
+	tagsURL := bitbucketAPIURL + "/repositories/" + m.repoName + "/refs/tags?pagelen=100&sort=-target.date"
+	if m.version != "" {
+		tagsURL += "&q=" + url.QueryEscape(fmt.Sprintf("name=%q", m.version))
+	}
+
+	for tagsURL != "" {
+		body, _, derr := bitbucket.getJSON(tagsURL)
+		if derr != nil {
+			return derr
+		}
+
+		var tags bbTags
+		if err := json.Unmarshal(body, &tags); err != nil {
+			return &DownloadError{err, false}
+		}
+
+		if m.version == "" {
+			if len(tags.Values) == 0 {
+				break
+			}
+			m.version, m.commit = tags.Values[0].Name, tags.Values[0].Target.Hash
+			return nil
+		}
+
+		for _, tag := range tags.Values {
+			if tag.Name == m.version {
+				m.commit = tag.Target.Hash
+				return nil
+			}
+		}
+
+		tagsURL = tags.Next
+	}
+
+	if m.version == "" {
+		return &DownloadError{fmt.Errorf("Could not find any version for module %s", m.Name()), false}
+	}
+
+	return &DownloadError{fmt.Errorf("Could not find version %s for module %s", m.version, m.Name()), false}
+}
+
+func (m *BitbucketTarballModule) Download(to string, cache string) *DownloadError {
+	var cacheFile string
+	var derr *DownloadError
+
+	if offline {
+		if cacheFile, derr = resolveCachedRelease(&m.version, path.Join(cache, m.hash()), m.Name()); derr != nil {
+			return derr
+		}
+	} else if derr = m.resolveVersion(); derr != nil {
+		return derr
+	} else {
+		cacheFile = releaseArchive(path.Join(cache, m.hash()), m.version, m.commit)
+	}
+
+	archiveURL := bitbucketURL + "/" + m.repoName + "/get/" + url.PathEscape(m.version) + ".tar.gz"
+
+	return bitbucket.downloadRelease(archiveURL, cache, cacheFile, "", to, m.version)
+}
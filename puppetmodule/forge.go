@@ -10,19 +10,30 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
 
-	"github.com/yannh/r10k-go/gzip"
+	"github.com/yannh/r10k-go/archive"
+	"github.com/yannh/r10k-go/store"
 )
 
 type ForgeModule struct {
-	name    string
-	version string
+	name     string
+	version  string
+	forgeURL string
 }
 
-func NewForgeModule(name, version string) *ForgeModule {
+// The Forge modules are downloaded from, unless the Puppetfile sets another one
+const defaultForgeURL = "https://forgeapi.puppetlabs.com"
+
+func NewForgeModule(name, version, forgeURL string) *ForgeModule {
+	if forgeURL == "" {
+		forgeURL = defaultForgeURL
+	}
+
 	return &ForgeModule{
-		name:    name,
-		version: version,
+		name:     name,
+		version:  version,
+		forgeURL: strings.TrimSuffix(forgeURL, "/"),
 	}
 }
 
@@ -30,12 +41,22 @@ func (m *ForgeModule) InstallPath() string {
 	return ""
 }
 
+// hash identifies the module on its Forge, where puppetlabs/stdlib is puppetlabs-stdlib
 func (m *ForgeModule) hash() string {
+	return cacheKey("forge", m.forgeURL, strings.Replace(m.name, "/", "-", -1))
+}
+
+// oldHash is the name of the cache entry of the module in previous versions of r10k-go
+func (m *ForgeModule) oldHash() string {
 	hasher := sha1.New()
 	hasher.Write([]byte(m.name))
 	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 }
 
+func (m *ForgeModule) CacheEntry() string {
+	return m.hash()
+}
+
 func (m *ForgeModule) Name() string {
 	return m.name
 }
@@ -47,25 +68,44 @@ type moduleReleases struct {
 	}
 }
 
-func (m *ForgeModule) downloadToCache(r io.Reader, cacheFolder string) error {
-	if err := os.MkdirAll(cacheFolder, 0755); err != nil {
-		return fmt.Errorf("failed creating folder %s: %v", cacheFolder, err)
+// downloadToCache downloads the archive next to cacheFile, and only moves
+// it in place once complete
+func (m *ForgeModule) downloadToCache(url string, cacheFile string) *DownloadError {
+	if err := os.MkdirAll(path.Dir(cacheFile), 0755); err != nil {
+		return &DownloadError{fmt.Errorf("failed creating folder %s: %v", path.Dir(cacheFile), err), false}
 	}
 
-	cacheFile := path.Join(cacheFolder, m.version+".tar.gz")
-	out, err := os.Create(cacheFile)
-	if err != nil {
-		return fmt.Errorf("failed creating cache file %s: %v", cacheFile, err)
+	r, derr := httpGet(url)
+	if derr != nil {
+		return derr
 	}
+	defer r.Close()
 
-	defer out.Close()
+	out, err := os.Create(cacheFile + ".part")
+	if err != nil {
+		return &DownloadError{fmt.Errorf("failed creating cache file %s: %v", cacheFile, err), false}
+	}
+	defer os.Remove(cacheFile + ".part")
 
 	_, err = io.Copy(out, r)
+	out.Close()
+	if err != nil {
+		return &DownloadError{fmt.Errorf("could not retrieve %s: %v", url, err), true}
+	}
+
+	if err = os.Rename(cacheFile+".part", cacheFile); err != nil {
+		return &DownloadError{err, false}
+	}
 
-	return err
+	return nil
 }
 
-func (m *ForgeModule) IsUpToDate(folder string) bool {
+// Floating returns true if no version is specified, as the latest one is deployed
+func (m *ForgeModule) Floating() bool {
+	return m.version == ""
+}
+
+func (m *ForgeModule) IsUpToDate(folder string, cache string) bool {
 	_, err := os.Stat(folder)
 	if err != nil {
 		return false
@@ -87,10 +127,9 @@ func (m *ForgeModule) IsUpToDate(folder string) bool {
 }
 
 func (m *ForgeModule) getArchiveURL() (string, error) {
-	forgeURL := "https://forgeapi.puppetlabs.com:443/"
 	APIVersion := "v3"
 
-	url := forgeURL + APIVersion + "/releases?" +
+	url := m.forgeURL + "/" + APIVersion + "/releases?" +
 		"module=" + m.Name() +
 		"&sort_by=release_date" +
 		"&limit=100"
@@ -146,39 +185,54 @@ func (m *ForgeModule) Download(to string, cache string) *DownloadError {
 
 	cacheFolder := path.Join(cache, m.hash())
 
-	forgeURL := "https://forgeapi.puppetlabs.com:443/"
-	if url, err = m.getArchiveURL(); err != nil {
+	if offline {
+		// Archives are named after their version, the latest version cached is deployed
+		if m.version == "" {
+			if m.version = latestCachedVersion(cacheFolder); m.version == "" {
+				return notCached("any version of %s from %s", m.name, m.forgeURL)
+			}
+		}
+		url = "/v3/files/" + strings.Replace(m.name, "/", "-", -1) + "-" + m.version + ".tar.gz"
+	} else if url, err = m.getArchiveURL(); err != nil {
 		return &DownloadError{err, true}
 	}
 
-	if _, err = os.Stat(path.Join(cacheFolder, m.version+".tar.gz")); err != nil {
-		forgeArchive, err := http.Get(forgeURL + url)
-		if err != nil {
-			return &DownloadError{fmt.Errorf("could not retrieve %s", forgeURL+url), true}
-		}
-		defer forgeArchive.Body.Close()
-
-		if err := m.downloadToCache(forgeArchive.Body, cacheFolder); err != nil {
-			return &DownloadError{fmt.Errorf("could not retrieve %s", forgeURL+url), true}
-		}
+	l, derr := lockCacheFolder(cacheFolder)
+	if derr != nil {
+		return derr
 	}
-	r, err := os.Open(path.Join(cacheFolder, m.version+".tar.gz"))
-	if err != nil {
-		return &DownloadError{fmt.Errorf("could not write to %s", path.Join(cacheFolder, m.version+".tar.gz")), false}
-	}
-	defer r.Close()
+	defer l.Release()
 
-	if err = gzip.Extract(r, to); err != nil {
-		return &DownloadError{err, true}
+	cacheFile := path.Join(cacheFolder, m.version+".tar.gz")
+
+	// Previous versions of r10k-go only downloaded from the default Forge
+	if m.forgeURL == defaultForgeURL {
+		migrateArchive(cache, path.Join(cache, m.oldHash(), m.version+".tar.gz"), cacheFile, m.forgeURL+url)
 	}
 
-	versionFile := path.Join(to, ".Version")
-	f, err := os.OpenFile(versionFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return &DownloadError{fmt.Errorf("could not create file %s", versionFile), false}
+	derr = fetchArchive(cache, cacheFile, m.forgeURL+url, nil, func() *DownloadError {
+		return m.downloadToCache(m.forgeURL+url, cacheFile)
+	})
+	if derr != nil {
+		return derr
 	}
-	defer f.Close()
-	f.WriteString(m.version)
 
-	return nil
+	return deploy(cache, store.Key("forge", m.forgeURL, m.name, m.version), to, func(folder string) *DownloadError {
+		r, err := os.Open(cacheFile)
+		if err != nil {
+			return &DownloadError{fmt.Errorf("could not write to %s", cacheFile), false}
+		}
+		defer r.Close()
+
+		if err = archive.Extract(r, folder); err != nil {
+			return &DownloadError{err, true}
+		}
+
+		versionFile := path.Join(folder, ".Version")
+		if err = ioutil.WriteFile(versionFile, []byte(m.version), 0644); err != nil {
+			return &DownloadError{fmt.Errorf("could not create file %s", versionFile), false}
+		}
+
+		return nil
+	})
 }
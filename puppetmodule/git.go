@@ -1,16 +1,15 @@
 package puppetmodule
 
 import (
-	"bufio"
-	"crypto/sha1"
-	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"strings"
 
 	"github.com/yannh/r10k-go/git"
+	"github.com/yannh/r10k-go/sidecar"
+	"github.com/yannh/r10k-go/store"
 )
 
 type GitModule struct {
@@ -18,14 +17,64 @@ type GitModule struct {
 	repoURL     string   // https://github.com/puppetlabs/puppetlabs-apache.git
 	installPath string   // if specified per module, otherwise empty string
 	want        *git.Ref // The tag, branch or ref
+	opts        GitModuleOptions
 }
 
-func NewGitModule(name, repoURL, installPath string, want *git.Ref) *GitModule {
+// GitModuleOptions are the optional parameters of a git module in the Puppetfile
+type GitModuleOptions struct {
+	Clone  git.CloneOptions
+	Path   string // Only deploy this folder of the repository
+	Deploy string // DeployWorktree or DeployExport, defaults to the global deploy mode
+
+	VerifySignatures string // "true" or "false", defaults to the global setting
+}
+
+// Git modules are either deployed as worktrees of the cache repository, or exported
+// as plain files, which do not depend on the cache once deployed
+const (
+	DeployWorktree = "worktree"
+	DeployExport   = "export"
+)
+
+var defaultGitDeploy = DeployWorktree
+
+var defaultVerifySignatures bool
+var signaturesKeyring string
+
+// SetSignatureVerification sets whether git modules are only deployed when signed by a key
+// of the keyring, unless specified in the Puppetfile
+func SetSignatureVerification(verify bool, keyring string) {
+	defaultVerifySignatures = verify
+	signaturesKeyring = keyring
+}
+
+// DefaultGitDeploy returns how git modules are deployed when not specified in the Puppetfile
+func DefaultGitDeploy() string { return defaultGitDeploy }
+
+// SetDefaultGitDeploy sets how git modules are deployed when not specified in the Puppetfile
+func SetDefaultGitDeploy(mode string) error {
+	switch mode {
+	case "":
+		defaultGitDeploy = DeployWorktree
+	case DeployWorktree, DeployExport:
+		defaultGitDeploy = mode
+	default:
+		return fmt.Errorf("unsupported git deploy mode %s", mode)
+	}
+
+	return nil
+}
+
+// Modules deployed as plain files record the commit they were exported from in this file
+const commitFile = ".commit"
+
+func NewGitModule(name, repoURL, installPath string, want *git.Ref, opts GitModuleOptions) *GitModule {
 	return &GitModule{
 		name:        name,
 		repoURL:     repoURL,
 		installPath: installPath,
 		want:        want,
+		opts:        opts,
 	}
 }
 
@@ -34,80 +83,133 @@ func (m *GitModule) InstallPath() string {
 	return m.installPath
 }
 
-func (m *GitModule) IsUpToDate(folder string) bool {
+// exported returns true if the module is deployed as plain files.
+// Folders of a repository can not be deployed as worktrees.
+func (m *GitModule) exported() bool {
+	if m.opts.Path != "" {
+		return true
+	}
+
+	if m.opts.Deploy != "" {
+		return m.opts.Deploy == DeployExport
+	}
+
+	return defaultGitDeploy == DeployExport
+}
+
+func (m *GitModule) verifySignatures() bool {
+	if m.opts.VerifySignatures != "" {
+		return m.opts.VerifySignatures == "true"
+	}
+
+	return defaultVerifySignatures
+}
+
+// Floating returns true unless the module is deployed from a tag or a commit
+func (m *GitModule) Floating() bool {
+	return !m.want.Pinned()
+}
+
+func (m *GitModule) IsUpToDate(folder string, cache string) bool {
 	if _, err := os.Stat(folder); err != nil {
 		return false
 	}
 
+	// The module was deployed using another deploy mode
+	if _, err := os.Stat(path.Join(folder, ".git")); (err == nil) == m.exported() {
+		return false
+	}
+
 	// folder exists, but no version specified, anything goes
 	if m.want == nil {
 		return true
 	}
 
-	cmd := exec.Command("git", "show", "-s", "--pretty=%d", "HEAD")
-	cmd.Dir = folder
-	output, err := cmd.Output()
-	if err != nil {
-		return false
-	}
+	if m.exported() {
+		commit, err := ioutil.ReadFile(path.Join(folder, commitFile))
+		if err != nil {
+			return false
+		}
 
-	switch m.want.RefType {
-	case git.TypeRef:
-		commit, err := m.currentCommit(folder)
+		wanted, err := git.ResolveRef(path.Join(cache, m.hash()), m.want)
 		if err != nil {
 			return false
 		}
 
-		return strings.Contains(string(output), "origin/"+m.want.Ref) ||
-			strings.Contains(string(output), "tag: "+m.want.Ref) ||
-			m.want.Ref == commit
+		return strings.TrimSpace(string(commit)) == wanted
+	}
 
-	case git.TypeBranch:
-		return strings.Contains(string(output), "origin/"+m.want.Ref)
+	// Worktrees share their references with the cache repository
+	current, err := git.ResolveRef(folder, nil)
+	if err != nil {
+		return false
+	}
 
-	case git.TypeTag:
-		return strings.Contains(string(output), "tag: "+m.want.Ref)
+	wanted, err := git.ResolveRef(folder, m.want)
+	if err != nil {
+		return false
 	}
 
-	return false
+	return current == wanted
 }
 
-func (m *GitModule) hash() string {
-	hasher := sha1.New()
-	hasher.Write([]byte(m.repoURL))
-	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+// DeployedVersion returns the commit the module in folder was deployed from,
+// or an empty string if it can not be found
+func (m *GitModule) DeployedVersion(folder string) string {
+	return DeployedCommit(folder)
 }
 
-func (m *GitModule) currentCommit(folder string) (string, error) {
-	var gitFile, headFile *os.File
-	var err error
-	worktreeFolder := ""
+// DeployedCommit returns the commit a git module deployed in folder was deployed from,
+// or an empty string if it can not be found
+func DeployedCommit(folder string) string {
+	if commit, err := ioutil.ReadFile(path.Join(folder, commitFile)); err == nil {
+		return strings.TrimSpace(string(commit))
+	}
 
-	if gitFile, err = os.Open(path.Join(folder, ".git")); err != nil {
-		return "", fmt.Errorf("Error getting current commit for %s", m.Name())
+	if _, err := os.Stat(path.Join(folder, ".git")); err != nil {
+		return ""
 	}
 
-	defer gitFile.Close()
+	commit, err := git.ResolveRef(folder, nil)
+	if err != nil {
+		return ""
+	}
 
-	scanner := bufio.NewScanner(gitFile)
+	return commit
+}
 
-	for scanner.Scan() {
-		t := scanner.Text()
-		if strings.HasPrefix(t, "gitdir:") {
-			worktreeFolder = strings.Trim(strings.Split(t, ":")[1], " ")
-		}
+// Changes lists the changes between the commit from and the wanted commit
+func (m *GitModule) Changes(from string, cache string) (*git.Changes, error) {
+	cacheFolder := path.Join(cache, m.hash())
+
+	to, err := git.ResolveRef(cacheFolder, m.want)
+	if err != nil {
+		return nil, err
 	}
 
-	if headFile, err = os.Open(path.Join(worktreeFolder, "HEAD")); err != nil {
-		return "", fmt.Errorf("failed getting current commit for %s", m.Name())
+	return git.GetChanges(cacheFolder, from, to, m.opts.Path)
+}
+
+// describeRef returns the wanted ref as written in the Puppetfile, eg tag v1.0.0
+func (m *GitModule) describeRef() string {
+	switch {
+	case m.want == nil:
+		return "HEAD"
+	case m.want.RefType == git.TypeTag:
+		return "tag " + m.want.Ref
+	case m.want.RefType == git.TypeBranch:
+		return "branch " + m.want.Ref
 	}
-	defer headFile.Close()
 
-	scanner = bufio.NewScanner(headFile)
-	scanner.Scan()
-	version := scanner.Text()
+	return "ref " + m.want.Ref
+}
+
+func (m *GitModule) hash() string {
+	return git.RepoHash(m.repoURL)
+}
 
-	return version, nil
+func (m *GitModule) CacheEntry() string {
+	return m.hash()
 }
 
 func (m *GitModule) updateCache(cacheFolder string) error {
@@ -117,14 +219,14 @@ func (m *GitModule) updateCache(cacheFolder string) error {
 			os.RemoveAll(cacheFolder)
 		} else {
 			// cache exists and is a git repository, we try to update it
-			if err := git.Fetch(cacheFolder); err != nil {
+			if err := git.FetchRemote(cacheFolder, m.repoURL); err != nil {
 				return &DownloadError{error: err, Retryable: true}
 			}
 			return nil
 		}
 	}
 
-	if err := git.Clone(m.repoURL, cacheFolder); err != nil {
+	if err := git.Clone(m.repoURL, cacheFolder, m.opts.Clone); err != nil {
 		return &DownloadError{error: err, Retryable: true}
 	}
 
@@ -134,17 +236,94 @@ func (m *GitModule) updateCache(cacheFolder string) error {
 func (m *GitModule) Download(to string, cache string) *DownloadError {
 	var err error
 
-	if err = m.updateCache(path.Join(cache, m.hash())); err != nil {
-		return &DownloadError{error: fmt.Errorf("failed updating cache: %v", err), Retryable: true}
+	cacheFolder := path.Join(cache, m.hash())
+	l, derr := lockCacheFolder(cacheFolder)
+	if derr != nil {
+		return derr
+	}
+	defer l.Release()
+
+	if offline {
+		// Refs are resolved from the cached repository, as last fetched
+		if err = git.RevParse(cacheFolder); err != nil {
+			return notCached("repository %s", m.repoURL)
+		}
+		if _, err = git.ResolveRef(cacheFolder, m.want); err != nil {
+			return notCached("%s of %s", m.describeRef(), m.repoURL)
+		}
+	} else {
+		if err = m.updateCache(cacheFolder); err != nil {
+			return &DownloadError{error: fmt.Errorf("failed updating cache: %v", err), Retryable: true}
+		}
+
+		if err = sidecar.Record(cache, m.hash(), m.repoURL, ""); err != nil {
+			return &DownloadError{error: fmt.Errorf("failed updating cache: %v", err), Retryable: false}
+		}
+	}
+
+	// The wanted commit might be older than the history of a shallow clone
+	if _, err = git.ResolveRef(cacheFolder, m.want); err != nil && git.IsShallow(cacheFolder) {
+		if err = git.Unshallow(cacheFolder); err != nil {
+			return &DownloadError{error: fmt.Errorf("failed updating cache: %v", err), Retryable: true}
+		}
+	}
+
+	if m.verifySignatures() {
+		if err = git.VerifySignature(cacheFolder, m.want, signaturesKeyring); err != nil {
+			return &DownloadError{error: fmt.Errorf("failed verifying signature: %v", err), Retryable: false}
+		}
 	}
 
 	if err = os.MkdirAll(path.Join(to, ".."), 0755); err != nil {
 		return &DownloadError{error: fmt.Errorf("failed creating folder: %v", to), Retryable: false}
 	}
 
-	if err = git.WorktreeAdd(path.Join(cache, m.hash()), m.want, to); err != nil {
+	if m.exported() {
+		return m.export(cacheFolder, to, cache)
+	}
+
+	if err = git.WorktreeAdd(cacheFolder, m.want, to); err != nil {
 		return &DownloadError{error: fmt.Errorf("failed creating subtree: %v", err), Retryable: true}
 	}
 
+	if err = git.UpdateSubmodules(to, m.repoURL, cache); err != nil {
+		if offline {
+			return notCached("submodules of %s: %v", m.repoURL, err)
+		}
+		return &DownloadError{error: fmt.Errorf("failed updating submodules: %v", err), Retryable: true}
+	}
+
 	return nil
 }
+
+// export deploys the files of the repository as plain files, without git metadata
+func (m *GitModule) export(cacheFolder string, to string, cache string) *DownloadError {
+	commit, err := git.ResolveRef(cacheFolder, m.want)
+	if err != nil {
+		return &DownloadError{error: err, Retryable: false}
+	}
+	ref := git.NewRef(git.TypeRef, commit)
+
+	return deploy(cache, store.Key("git", commit, m.opts.Path), to, func(folder string) *DownloadError {
+		if err = git.Export(cacheFolder, ref, m.opts.Path, folder); err != nil {
+			return &DownloadError{error: fmt.Errorf("failed exporting %s: %v", m.opts.Path, err), Retryable: false}
+		}
+
+		// Submodules are only deployed along with the whole repository
+		if m.opts.Path == "" {
+			if err = git.ExportSubmodules(cacheFolder, ref, folder, m.repoURL, cache); err != nil {
+				if offline {
+					return notCached("submodules of %s: %v", m.repoURL, err)
+				}
+				return &DownloadError{error: fmt.Errorf("failed exporting submodules: %v", err), Retryable: true}
+			}
+		}
+
+		commitFilename := path.Join(folder, commitFile)
+		if err = ioutil.WriteFile(commitFilename, []byte(commit), 0644); err != nil {
+			return &DownloadError{error: fmt.Errorf("failed creating file %s", commitFilename), Retryable: false}
+		}
+
+		return nil
+	})
+}
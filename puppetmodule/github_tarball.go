@@ -5,25 +5,41 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
-	"os"
 	"path"
-
-	"github.com/yannh/r10k-go/gzip"
+	"strings"
 )
 
 type GithubTarballModule struct {
 	name        string
 	repoName    string
 	version     string
+	commit      string // Commit of the tag, once resolved
 	installPath string
 }
 
 type ghModuleRelease []struct {
 	Name       string
 	TarballURL string `json:"tarball_url"`
+	Commit     struct {
+		SHA string
+	}
+}
+
+var githubAPIURL = "https://api.github.com"
+var github = &releaseAPI{name: "GitHub", header: http.Header{"Accept": {"application/vnd.github.v3+json"}}}
+
+// SetGithubConfig sets the URL of the GitHub API, eg https://github.example.com/api/v3
+// for GitHub Enterprise, and the token used to authenticate
+func SetGithubConfig(apiURL, token string) {
+	if apiURL != "" {
+		githubAPIURL = strings.TrimSuffix(apiURL, "/")
+	}
+
+	github.header.Del("Authorization")
+	if token != "" {
+		github.header.Set("Authorization", "token "+token)
+	}
 }
 
 func NewGithubTarballModule(name, repoName, version, installPath string) *GithubTarballModule {
@@ -44,131 +60,84 @@ func (m *GithubTarballModule) InstallPath() string {
 }
 
 func (m *GithubTarballModule) hash() string {
+	return cacheKey("github", githubAPIURL, m.repoName)
+}
+
+// oldHash is the name of the cache entry of the module in previous versions of r10k-go
+func (m *GithubTarballModule) oldHash() string {
 	hasher := sha1.New()
 	hasher.Write([]byte(m.name))
 	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 }
 
-func (m *GithubTarballModule) IsUpToDate(folder string) bool {
-	_, err := os.Stat(folder)
-	if err != nil {
-		return false
-	} else if m.version == "" {
-		// Module is present and no version specified...
-		return true
-	}
-
-	versionFile := path.Join(folder, ".version")
-	version, err := ioutil.ReadFile(versionFile)
-	if err != nil {
-		// TODO error handling
-		fmt.Println("Error opening version file :" + err.Error())
-		return false
-	}
-	v := string(version)
-
-	return v == m.version
+func (m *GithubTarballModule) CacheEntry() string {
+	return m.hash()
 }
 
-func (m *GithubTarballModule) downloadToCache(r io.Reader, cacheFolder string) error {
-	if err := os.MkdirAll(path.Join(cacheFolder), 0755); err != nil {
-		return err
-	}
-
-	out, err := os.Create(path.Join(cacheFolder, m.version+".tar.gz"))
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, r)
-
-	return err
+// Floating returns true if no version is specified, as the latest tag is deployed
+func (m *GithubTarballModule) Floating() bool {
+	return m.version == ""
 }
 
-func (m *GithubTarballModule) downloadURL() (string, error) {
-	ghAPIRoot := "https://api.github.com"
-
-	url := ghAPIRoot + "/repos/" + m.repoName + "/tags"
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", &DownloadError{err, true}
-	}
-	defer resp.Body.Close()
+func (m *GithubTarballModule) IsUpToDate(folder string, cache string) bool {
+	return releaseIsUpToDate(folder, m.version)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", &DownloadError{fmt.Errorf("failed retrieving URL - %s", resp.Status), true}
-	}
+// downloadURL returns the URL of the tarball of the wanted tag, or of the latest tag
+// if no version was specified. Tags are paginated, older ones are on the last pages.
+func (m *GithubTarballModule) downloadURL() (string, *DownloadError) {
+	url := githubAPIURL + "/repos/" + m.repoName + "/tags?per_page=100"
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", &DownloadError{err, true}
-	}
+	for url != "" {
+		body, header, derr := github.getJSON(url)
+		if derr != nil {
+			return "", derr
+		}
 
-	var gr ghModuleRelease
-	if err = json.Unmarshal(body, &gr); err != nil {
-		return "", err
-	}
+		var gr ghModuleRelease
+		if err := json.Unmarshal(body, &gr); err != nil {
+			return "", &DownloadError{err, false}
+		}
 
-	index := 0
-	if m.version != "" {
-		versionFound := false
-		for i, result := range gr {
-			if m.version == result.Name {
-				versionFound = true
-				index = i
+		if m.version == "" {
+			if len(gr) == 0 {
 				break
 			}
+			m.version, m.commit = gr[0].Name, gr[0].Commit.SHA
+			return gr[0].TarballURL, nil
 		}
-		if !versionFound {
-			return "", &DownloadError{fmt.Errorf("Could not find version %s for module %s", m.version, m.Name()), false}
-		}
-	} else {
-		m.version = gr[0].Name
-	}
 
-	return gr[index].TarballURL, nil
-}
-
-func (m *GithubTarballModule) Download(to string, cache string) *DownloadError {
-	var err error
-	var url string
-
-	cacheFolder := path.Join(cache, m.hash())
-
-	if url, err = m.downloadURL(); err != nil {
-		return &DownloadError{err, true}
-	}
-
-	if _, err = os.Stat(path.Join(cacheFolder, m.version+".tar.gz")); err != nil {
-		forgeArchive, err := http.Get(url)
-		if err != nil {
-			return &DownloadError{fmt.Errorf("Failed retrieving %s", url), true}
+		for _, result := range gr {
+			if m.version == result.Name {
+				m.commit = result.Commit.SHA
+				return result.TarballURL, nil
+			}
 		}
-		defer forgeArchive.Body.Close()
 
-		m.downloadToCache(forgeArchive.Body, cacheFolder)
+		url = nextPage(header)
 	}
 
-	r, err := os.Open(path.Join(cacheFolder, m.version+".tar.gz"))
-	if err != nil {
-		return &DownloadError{err, false}
+	if m.version == "" {
+		return "", &DownloadError{fmt.Errorf("Could not find any version for module %s", m.Name()), false}
 	}
 
-	defer r.Close()
+	return "", &DownloadError{fmt.Errorf("Could not find version %s for module %s", m.version, m.Name()), false}
+}
 
-	if err = gzip.Extract(r, to); err != nil {
-		return &DownloadError{err, false}
-	}
+func (m *GithubTarballModule) Download(to string, cache string) *DownloadError {
+	var url, cacheFile string
+	var derr *DownloadError
 
-	versionFile := path.Join(to, ".version")
-	r, err = os.OpenFile(versionFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return &DownloadError{fmt.Errorf("Failed creating file %s", versionFile), false}
+	if offline {
+		if cacheFile, derr = resolveCachedRelease(&m.version, path.Join(cache, m.hash()), m.Name()); derr != nil {
+			return derr
+		}
+		url = githubAPIURL + "/repos/" + m.repoName + "/tarball/" + m.version
+	} else if url, derr = m.downloadURL(); derr != nil {
+		return derr
+	} else {
+		cacheFile = releaseArchive(path.Join(cache, m.hash()), m.version, m.commit)
 	}
-	defer r.Close()
-	r.WriteString(m.version)
 
-	return nil
+	return github.downloadRelease(url, cache, cacheFile, path.Join(cache, m.oldHash(), m.version+".tar.gz"), to, m.version)
 }
@@ -0,0 +1,139 @@
+package puppetmodule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// GitlabTarballModule is deployed from the archive of a tag of a GitLab project
+type GitlabTarballModule struct {
+	name        string
+	project     string // Path of the project, eg group/subgroup/project
+	version     string
+	commit      string // Commit of the tag, once resolved
+	installPath string
+}
+
+type glTag struct {
+	Name   string
+	Commit struct {
+		ID string
+	}
+}
+
+var gitlabURL = "https://gitlab.com"
+var gitlab = &releaseAPI{name: "GitLab", header: http.Header{}}
+
+// SetGitlabConfig sets the URL of the GitLab instance, eg https://gitlab.example.com,
+// and the token used to authenticate
+func SetGitlabConfig(baseURL, token string) {
+	if baseURL != "" {
+		gitlabURL = strings.TrimSuffix(baseURL, "/")
+	}
+
+	gitlab.header.Del("Private-Token")
+	if token != "" {
+		gitlab.header.Set("Private-Token", token)
+	}
+}
+
+func NewGitlabTarballModule(name, project, version, installPath string) *GitlabTarballModule {
+	return &GitlabTarballModule{
+		name:        name,
+		project:     strings.Trim(project, "/"),
+		version:     version,
+		installPath: installPath,
+	}
+}
+
+func (m *GitlabTarballModule) Name() string        { return m.name }
+func (m *GitlabTarballModule) InstallPath() string { return m.installPath }
+
+func (m *GitlabTarballModule) hash() string {
+	return cacheKey("gitlab", gitlabURL, m.project)
+}
+
+func (m *GitlabTarballModule) CacheEntry() string {
+	return m.hash()
+}
+
+// Floating returns true if no version is specified, as the latest tag is deployed
+func (m *GitlabTarballModule) Floating() bool {
+	return m.version == ""
+}
+
+func (m *GitlabTarballModule) IsUpToDate(folder string, cache string) bool {
+	return releaseIsUpToDate(folder, m.version)
+}
+
+// projectURL returns the API URL of the project, which is referenced by its URL-encoded path
+func (m *GitlabTarballModule) projectURL() string {
+	return gitlabURL + "/api/v4/projects/" + url.PathEscape(m.project)
+}
+
+// resolveVersion sets the version to the latest tag if none was specified, or checks
+// that the tag exists. Tags are listed by last update, the latest first.
+func (m *GitlabTarballModule) resolveVersion() *DownloadError {
+	tagsURL := m.projectURL() + "/repository/tags?per_page=100"
+	if m.version != "" {
+		tagsURL += "&search=" + url.QueryEscape("^"+m.version)
+	}
+
+	for tagsURL != "" {
+		body, header, derr := gitlab.getJSON(tagsURL)
+		if derr != nil {
+			return derr
+		}
+
+		var tags []glTag
+		if err := json.Unmarshal(body, &tags); err != nil {
+			return &DownloadError{err, false}
+		}
+
+		if m.version == "" {
+			if len(tags) == 0 {
+				break
+			}
+			m.version, m.commit = tags[0].Name, tags[0].Commit.ID
+			return nil
+		}
+
+		for _, tag := range tags {
+			if tag.Name == m.version {
+				m.commit = tag.Commit.ID
+				return nil
+			}
+		}
+
+		tagsURL = nextPage(header)
+	}
+
+	if m.version == "" {
+		return &DownloadError{fmt.Errorf("Could not find any version for module %s", m.Name()), false}
+	}
+
+	return &DownloadError{fmt.Errorf("Could not find version %s for module %s", m.version, m.Name()), false}
+}
+
+func (m *GitlabTarballModule) Download(to string, cache string) *DownloadError {
+	var cacheFile string
+	var derr *DownloadError
+
+	if offline {
+		if cacheFile, derr = resolveCachedRelease(&m.version, path.Join(cache, m.hash()), m.Name()); derr != nil {
+			return derr
+		}
+	} else if derr = m.resolveVersion(); derr != nil {
+		return derr
+	} else {
+		cacheFile = releaseArchive(path.Join(cache, m.hash()), m.version, m.commit)
+	}
+
+	archiveURL := m.projectURL() + "/repository/archive.tar.gz?sha=" + url.QueryEscape(m.version)
+
+	return gitlab.downloadRelease(archiveURL, cache, cacheFile, "", to, m.version)
+}
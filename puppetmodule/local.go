@@ -0,0 +1,28 @@
+package puppetmodule
+
+// LocalModule is a module committed in the moduledir of the control repository,
+// declared in the Puppetfile with :local => true. It is deployed along with the
+// environment, so r10k-go never downloads, replaces nor removes it.
+type LocalModule struct {
+	name string
+}
+
+func NewLocalModule(name string) *LocalModule {
+	return &LocalModule{name: name}
+}
+
+func (m *LocalModule) Name() string        { return m.name }
+func (m *LocalModule) InstallPath() string { return "" }
+
+// Floating returns false, as the module is deployed along with the environment
+func (m *LocalModule) Floating() bool {
+	return false
+}
+
+func (m *LocalModule) IsUpToDate(folder string, cache string) bool {
+	return true
+}
+
+func (m *LocalModule) Download(to string, cache string) *DownloadError {
+	return nil
+}
@@ -1,14 +1,91 @@
 package puppetmodule
 
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/yannh/r10k-go/git"
+	"github.com/yannh/r10k-go/lock"
+)
+
 type DownloadError struct {
 	error
 	Retryable bool
 }
 
+func NewDownloadError(err error, retryable bool) *DownloadError {
+	return &DownloadError{err, retryable}
+}
+
+// ErrNotCached is returned while offline, when a module can not be deployed from the cache
+type ErrNotCached struct {
+	Missing string // What is missing from the cache, eg a version or a commit
+}
+
+func (e ErrNotCached) Error() string {
+	return "not available offline, missing from the cache: " + e.Missing
+}
+
+// notCached returns the error of a module that can not be deployed offline
+func notCached(format string, a ...interface{}) *DownloadError {
+	return &DownloadError{ErrNotCached{fmt.Sprintf(format, a...)}, false}
+}
+
+// IsNotCached returns true if the module could not be deployed offline
+func (e *DownloadError) IsNotCached() bool {
+	_, ok := e.error.(ErrNotCached)
+	return ok
+}
+
+var offline bool
+
+// SetOffline makes modules deploy only from the cache, without any network access
+func SetOffline(o bool) {
+	offline = o
+}
+
 // PuppetModule is implemented by ForgeModule, gitModule, githubTarballModule, ....
 type PuppetModule interface {
 	Download(to string, cache string) *DownloadError
 	InstallPath() string
-	IsUpToDate(folder string) bool
+	IsUpToDate(folder string, cache string) bool
 	Name() string
 }
+
+// ChangeReporter is implemented by modules that can list what changed when they are updated
+type ChangeReporter interface {
+	DeployedVersion(folder string) string
+	Changes(from string, cache string) (*git.Changes, error)
+}
+
+// Floating is implemented by modules that can be updated without the Puppetfile changing,
+// eg git modules deployed from a branch, or Forge modules without a version
+type Floating interface {
+	Floating() bool
+}
+
+// Cached is implemented by modules downloaded to the cache
+type Cached interface {
+	CacheEntry() string // Folder of the module in the cache
+}
+
+// lockCacheFolder locks a folder of the cache, so it is only updated by a single
+// deploy at once, including by other processes
+func lockCacheFolder(folder string) (*lock.Lock, *DownloadError) {
+	l, err := lock.Acquire(folder + ".lock")
+	if err != nil {
+		return nil, &DownloadError{err, true}
+	}
+
+	return l, nil
+}
+
+// cacheKey returns the name of the folder of the cache a module is downloaded to,
+// from the type of the module and what identifies it at its source
+func cacheKey(parts ...string) string {
+	hasher := sha1.New()
+	hasher.Write([]byte(strings.Join(parts, "\x00")))
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+}
@@ -0,0 +1,464 @@
+package puppetmodule
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/yannh/r10k-go/store"
+)
+
+func TestRateLimitWait(t *testing.T) {
+	inAMinute := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	aMinuteAgo := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+
+	testCases := []struct {
+		header   http.Header
+		min, max time.Duration
+		limited  bool
+	}{
+		{http.Header{"Retry-After": {"30"}}, 30 * time.Second, 30 * time.Second, true},
+		{http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {inAMinute}}, 59 * time.Second, 62 * time.Second, true},
+		{http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {inAMinute}}, 59 * time.Second, 62 * time.Second, true},
+		{http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {aMinuteAgo}}, 0, 0, true},
+		{http.Header{"X-Ratelimit-Remaining": {"12"}, "X-Ratelimit-Reset": {inAMinute}}, 0, 0, false},
+		{http.Header{"X-Ratelimit-Remaining": {"0"}}, 0, 0, false},
+		{http.Header{}, 0, 0, false},
+	}
+
+	for _, c := range testCases {
+		wait, limited := rateLimitWait(c.header)
+		if limited != c.limited {
+			t.Errorf("expected %v to be rate limited: %v, got %v", c.header, c.limited, limited)
+		}
+		if wait < c.min || wait > c.max {
+			t.Errorf("expected %v to wait between %s and %s, got %s", c.header, c.min, c.max, wait)
+		}
+	}
+}
+
+func TestNextPage(t *testing.T) {
+	testCases := []struct {
+		link, expected string
+	}{
+		{`<https://api.github.com/repositories/1/tags?page=2>; rel="next", <https://api.github.com/repositories/1/tags?page=5>; rel="last"`, "https://api.github.com/repositories/1/tags?page=2"},
+		{`<https://api.github.com/repositories/1/tags?page=1>; rel="first", <https://api.github.com/repositories/1/tags?page=3>; rel="next"`, "https://api.github.com/repositories/1/tags?page=3"},
+		{`<https://gitlab.com/api/v4/projects/1/repository/tags?page=1>; rel="first", <https://gitlab.com/api/v4/projects/1/repository/tags?page=1>; rel="last"`, ""},
+		{`<https://api.github.com/repositories/1/tags?page=2>`, ""},
+		{"", ""},
+	}
+
+	for _, c := range testCases {
+		if actual := nextPage(http.Header{"Link": {c.link}}); actual != c.expected {
+			t.Errorf("expected the next page of %s to be %s, got %s", c.link, c.expected, actual)
+		}
+	}
+}
+
+func TestReleaseAPIGet(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+
+		switch r.URL.Path {
+		case "/limited":
+			// The rate limit resets right away after the first request
+			if requests == 1 {
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Unix(), 10))
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte("[]"))
+
+		case "/exhausted":
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+			w.WriteHeader(http.StatusForbidden)
+
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	a := &releaseAPI{name: "Test", header: http.Header{}}
+
+	resp, err := a.get(server.URL + "/limited")
+	if err != nil {
+		t.Fatalf("failed retrieving %s: %v", server.URL+"/limited", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || requests != 2 {
+		t.Errorf("expected the request to be sent again once the rate limit reset, got %s after %d requests", resp.Status, requests)
+	}
+
+	if _, err = a.get(server.URL + "/exhausted"); err == nil {
+		t.Errorf("expected an error when the rate limit resets too late")
+	}
+
+	resp, err = a.get(server.URL + "/forbidden")
+	if err != nil {
+		t.Fatalf("failed retrieving %s: %v", server.URL+"/forbidden", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a 403 not caused by the rate limit to be returned, got %s", resp.Status)
+	}
+}
+
+func TestGithubDownloadURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/o/r/tags" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		type tag struct {
+			Name       string `json:"name"`
+			TarballURL string `json:"tarball_url"`
+			Commit     struct {
+				SHA string `json:"sha"`
+			} `json:"commit"`
+		}
+
+		var tags []tag
+		for i := 6; i >= 0; i-- {
+			tg := tag{Name: fmt.Sprintf("v%d", i), TarballURL: fmt.Sprintf("https://example.com/o/r/v%d.tar.gz", i)}
+			tg.Commit.SHA = fmt.Sprintf("commit%d", i)
+			tags = append(tags, tg)
+		}
+
+		// Tags are listed 3 per page, the oldest on the last page
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		if page*3 < len(tags) {
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s/repos/o/r/tags?per_page=100&page=%d>; rel="next"`, r.Host, page+1))
+			tags = tags[(page-1)*3 : page*3]
+		} else {
+			tags = tags[(page-1)*3:]
+		}
+		json.NewEncoder(w).Encode(tags)
+	}))
+	defer server.Close()
+
+	defer func(apiURL string) { githubAPIURL = apiURL }(githubAPIURL)
+	githubAPIURL = server.URL
+
+	testCases := []struct {
+		version, expectedVersion, expectedURL, expectedCommit string
+		found                                                 bool
+	}{
+		{"", "v6", "https://example.com/o/r/v6.tar.gz", "commit6", true},
+		{"v3", "v3", "https://example.com/o/r/v3.tar.gz", "commit3", true},
+		{"v0", "v0", "https://example.com/o/r/v0.tar.gz", "commit0", true},
+		{"v9", "v9", "", "", false},
+	}
+
+	for _, c := range testCases {
+		m := NewGithubTarballModule("o-r", "o/r", c.version, "")
+		url, derr := m.downloadURL()
+		if (derr == nil) != c.found {
+			t.Errorf("unexpected result looking up version %s: %v", c.version, derr)
+		}
+		if url != c.expectedURL || m.version != c.expectedVersion || m.commit != c.expectedCommit {
+			t.Errorf("expected version %s to resolve to %s %s %s, got %s %s %s", c.version, c.expectedVersion, c.expectedURL, c.expectedCommit, m.version, url, m.commit)
+		}
+	}
+}
+
+func TestGitlabResolveVersion(t *testing.T) {
+	var mu sync.Mutex
+	var searches []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/v4/projects/group%2Fproject/repository/tags" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		search := r.URL.Query().Get("search")
+		mu.Lock()
+		searches = append(searches, search)
+		mu.Unlock()
+
+		// Tags are filtered by the prefix searched, and listed one per page
+		var tags []map[string]interface{}
+		for _, name := range []string{"v1.10", "v1.1", "v1.0", "v0.1"} {
+			if strings.HasPrefix(search, "^") && !strings.HasPrefix(name, search[1:]) {
+				continue
+			}
+			tags = append(tags, map[string]interface{}{"name": name, "commit": map[string]string{"id": "commit-" + name}})
+		}
+
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		if page < len(tags) {
+			next := *r.URL
+			q := next.Query()
+			q.Set("page", strconv.Itoa(page+1))
+			next.RawQuery = q.Encode()
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s%s>; rel="next"`, r.Host, next.RequestURI()))
+			tags = tags[page-1 : page]
+		} else if page <= len(tags) {
+			tags = tags[page-1:]
+		}
+		json.NewEncoder(w).Encode(tags)
+	}))
+	defer server.Close()
+
+	defer func(baseURL string) { gitlabURL = baseURL }(gitlabURL)
+	gitlabURL = server.URL
+
+	testCases := []struct {
+		version, expectedVersion, expectedCommit, expectedSearch string
+		found                                                    bool
+	}{
+		{"", "v1.10", "commit-v1.10", "", true},
+		{"v1.1", "v1.1", "commit-v1.1", "^v1.1", true},
+		{"v0.1", "v0.1", "commit-v0.1", "^v0.1", true},
+		{"v1", "v1", "", "^v1", false},
+	}
+
+	for _, c := range testCases {
+		searches = nil
+		m := NewGitlabTarballModule("project", "/group/project/", c.version, "")
+		derr := m.resolveVersion()
+		if (derr == nil) != c.found {
+			t.Errorf("unexpected result looking up version %s: %v", c.version, derr)
+		}
+		if m.version != c.expectedVersion || m.commit != c.expectedCommit {
+			t.Errorf("expected version %s to resolve to %s %s, got %s %s", c.version, c.expectedVersion, c.expectedCommit, m.version, m.commit)
+		}
+		for _, search := range searches {
+			if search != c.expectedSearch {
+				t.Errorf("expected tags to be searched with %s looking up version %s, got %s", c.expectedSearch, c.version, search)
+			}
+		}
+	}
+
+	// v1.10 also starts with v1.1, and is listed first
+	m := NewGitlabTarballModule("project", "group/project", "v1.1", "")
+	searches = nil
+	if derr := m.resolveVersion(); derr != nil || m.commit != "commit-v1.1" || len(searches) != 2 {
+		t.Errorf("expected version v1.1 to be found on the second page, got %v %s after %d requests", derr, m.commit, len(searches))
+	}
+}
+
+func TestBitbucketResolveVersion(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The tags of the repository unfiltered are listed whatever the query
+		if r.URL.Path != "/repositories/workspace/repository/refs/tags" && r.URL.Path != "/repositories/workspace/unfiltered/refs/tags" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		query := r.URL.Query().Get("q")
+		mu.Lock()
+		queries = append(queries, query)
+		mu.Unlock()
+		if r.URL.Path == "/repositories/workspace/unfiltered/refs/tags" {
+			query = ""
+		}
+
+		// Tags are filtered by name, and listed 2 per page
+		type tag struct {
+			Name   string            `json:"name"`
+			Target map[string]string `json:"target"`
+		}
+		var tags []tag
+		for _, name := range []string{"v2.0", "v1.1", "v1.0"} {
+			if query != "" && query != fmt.Sprintf("name=%q", name) {
+				continue
+			}
+			tags = append(tags, tag{Name: name, Target: map[string]string{"hash": "commit-" + name}})
+		}
+
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		response := struct {
+			Values []tag  `json:"values"`
+			Next   string `json:"next,omitempty"`
+		}{}
+		if page*2 < len(tags) {
+			next := *r.URL
+			q := next.Query()
+			q.Set("page", strconv.Itoa(page+1))
+			next.RawQuery = q.Encode()
+			response.Next = "http://" + r.Host + next.RequestURI()
+			response.Values = tags[(page-1)*2 : page*2]
+		} else {
+			response.Values = tags[(page-1)*2:]
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	defer func(apiURL string) { bitbucketAPIURL = apiURL }(bitbucketAPIURL)
+	bitbucketAPIURL = server.URL
+
+	testCases := []struct {
+		version, expectedVersion, expectedCommit, expectedQuery string
+		found                                                   bool
+	}{
+		{"", "v2.0", "commit-v2.0", "", true},
+		{"v1.0", "v1.0", "commit-v1.0", `name="v1.0"`, true},
+		{"v1", "v1", "", `name="v1"`, false},
+	}
+
+	for _, c := range testCases {
+		queries = nil
+		m := NewBitbucketTarballModule("repository", "workspace/repository", c.version, "")
+		derr := m.resolveVersion()
+		if (derr == nil) != c.found {
+			t.Errorf("unexpected result looking up version %s: %v", c.version, derr)
+		}
+		if m.version != c.expectedVersion || m.commit != c.expectedCommit {
+			t.Errorf("expected version %s to resolve to %s %s, got %s %s", c.version, c.expectedVersion, c.expectedCommit, m.version, m.commit)
+		}
+		for _, query := range queries {
+			if query != c.expectedQuery {
+				t.Errorf("expected tags to be filtered with %s looking up version %s, got %s", c.expectedQuery, c.version, query)
+			}
+		}
+	}
+
+	m := NewBitbucketTarballModule("unfiltered", "workspace/unfiltered", "v1.0", "")
+	queries = nil
+	if derr := m.resolveVersion(); derr != nil || m.commit != "commit-v1.0" || len(queries) != 2 {
+		t.Errorf("expected version v1.0 to be found on the second page, got %v %s after %d requests", derr, m.commit, len(queries))
+	}
+}
+
+// moduleArchive returns a .tar.gz archive of a module whose init.pp contains content
+func moduleArchive(content string) []byte {
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	tw.WriteHeader(&tar.Header{Name: "vendor-foo/manifests/init.pp", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+	tw.Write([]byte(content))
+
+	tw.Close()
+	gzw.Close()
+
+	return buf.Bytes()
+}
+
+func inode(t *testing.T, file string) uint64 {
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("failed stating %s: %v", file, err)
+	}
+
+	return fi.Sys().(*syscall.Stat_t).Ino
+}
+
+func TestTarballModule(t *testing.T) {
+	archives := map[string][]byte{
+		"/foo-1.0.tar.gz": moduleArchive("class foo {}"),
+		"/foo-2.0.tar.gz": moduleArchive("class foo { notify { 'v2': } }"),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a, ok := archives[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(a)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "r10k-tarball")
+	if err != nil {
+		t.Fatalf("failed creating temporary folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := path.Join(dir, "cache")
+	url := server.URL + "/foo-1.0.tar.gz"
+	h := sha256.Sum256(archives["/foo-1.0.tar.gz"])
+	checksum := hex.EncodeToString(h[:])
+
+	// The archive is removed from the cache when it does not match the checksum
+	m := NewTarballModule("vendor-foo", url, strings.Repeat("0", 64), "")
+	derr := m.Download(path.Join(dir, "mismatch"), cache)
+	if derr == nil || derr.Retryable {
+		t.Errorf("expected a checksum mismatch to fail without retrying, got %v", derr)
+	}
+	if _, err = os.Stat(path.Join(cache, m.hash(), "archive.tar.gz")); err == nil {
+		t.Errorf("expected the archive not matching the checksum to be removed")
+	}
+
+	// Archives matching the checksum are deployed through the store
+	if err = SetStore(store.Hardlink); err != nil {
+		t.Fatal(err)
+	}
+	defer SetStore("")
+
+	to := path.Join(dir, "production", "foo")
+	m = NewTarballModule("vendor-foo", url, strings.ToUpper(checksum), "")
+	if derr = m.Download(to, cache); derr != nil {
+		t.Fatalf("failed deploying %s: %v", url, derr)
+	}
+
+	entry := path.Join(store.Folder(cache), store.Key("tarball", url, checksum))
+	if inode(t, path.Join(to, "manifests", "init.pp")) != inode(t, path.Join(entry, "manifests", "init.pp")) {
+		t.Errorf("expected %s to be deployed from the store", to)
+	}
+
+	testCases := []struct {
+		name     string
+		m        *TarballModule
+		upToDate bool
+	}{
+		{"same checksum", NewTarballModule("vendor-foo", url, checksum, ""), true},
+		{"no checksum", NewTarballModule("vendor-foo", url, "", ""), true},
+		{"other checksum", NewTarballModule("vendor-foo", url, strings.Repeat("0", 64), ""), false},
+		{"other URL", NewTarballModule("vendor-foo", server.URL+"/foo-2.0.tar.gz", "", ""), false},
+	}
+
+	for _, c := range testCases {
+		if upToDate := c.m.IsUpToDate(to, cache); upToDate != c.upToDate {
+			t.Errorf("%s: expected the module to be up to date: %v, got %v", c.name, c.upToDate, upToDate)
+		}
+	}
+
+	// The module is deployed again from the new URL
+	m = NewTarballModule("vendor-foo", server.URL+"/foo-2.0.tar.gz", "", "")
+	updated := path.Join(dir, "staging", "foo")
+	if derr = m.Download(updated, cache); derr != nil {
+		t.Fatalf("failed deploying %s: %v", server.URL+"/foo-2.0.tar.gz", derr)
+	}
+	if content, _ := ioutil.ReadFile(path.Join(updated, "manifests", "init.pp")); string(content) != "class foo { notify { 'v2': } }" {
+		t.Errorf("expected the module to be deployed from the new URL, got %s", content)
+	}
+	if !m.IsUpToDate(updated, cache) {
+		t.Errorf("expected the module deployed from the new URL to be up to date")
+	}
+}
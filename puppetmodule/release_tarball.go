@@ -0,0 +1,282 @@
+package puppetmodule
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yannh/r10k-go/archive"
+	"github.com/yannh/r10k-go/sidecar"
+	"github.com/yannh/r10k-go/store"
+)
+
+// Release tarball modules (GitHub, GitLab, Bitbucket) are deployed from the archive
+// of a tag, retrieved through the API of the platform hosting the repository
+
+// releaseAPI sends requests to the API of a code hosting platform
+type releaseAPI struct {
+	name   string      // Used in messages, eg GitHub
+	header http.Header // Sent with every request, eg to authenticate
+}
+
+// Requests are delayed until the rate limit resets, unless that takes longer than this
+const maxRateLimitWait = 10 * time.Minute
+
+// get sends a request to the API, waiting for the rate limit to reset when it was exceeded
+func (a *releaseAPI) get(url string) (*http.Response, error) {
+	for {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range a.header {
+			req.Header[k] = v
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+
+		wait, limited := rateLimitWait(resp.Header)
+		if !limited {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if wait > maxRateLimitWait {
+			return nil, fmt.Errorf("%s API rate limit exceeded, resets in %s", a.name, wait)
+		}
+
+		fmt.Printf("%s API rate limit exceeded, waiting %s\n", a.name, wait)
+		time.Sleep(wait)
+	}
+}
+
+// rateLimitWait returns how long to wait before sending another request,
+// and false if the response was not caused by the rate limit. GitHub prefixes
+// the rate limit headers with X-, GitLab does not.
+func rateLimitWait(h http.Header) (time.Duration, bool) {
+	if retryAfter, err := strconv.Atoi(h.Get("Retry-After")); err == nil {
+		return time.Duration(retryAfter) * time.Second, true
+	}
+
+	for _, prefix := range []string{"X-", ""} {
+		if h.Get(prefix+"RateLimit-Remaining") != "0" {
+			continue
+		}
+
+		reset, err := strconv.ParseInt(h.Get(prefix+"RateLimit-Reset"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		wait := time.Until(time.Unix(reset, 0)) + time.Second
+		if wait < 0 {
+			wait = 0
+		}
+
+		return wait, true
+	}
+
+	return 0, false
+}
+
+// nextPage returns the URL of the next page from the Link header, if any
+func nextPage(h http.Header) string {
+	for _, link := range strings.Split(h.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+
+	return ""
+}
+
+// getJSON retrieves a page of results from the API
+func (a *releaseAPI) getJSON(url string) ([]byte, http.Header, *DownloadError) {
+	resp, err := a.get(url)
+	if err != nil {
+		return nil, nil, &DownloadError{err, true}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &DownloadError{fmt.Errorf("failed retrieving %s - %s", url, resp.Status), resp.StatusCode != http.StatusNotFound}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, &DownloadError{err, true}
+	}
+
+	return body, resp.Header, nil
+}
+
+// releaseIsUpToDate returns true if the module in folder was deployed from the archive
+// of version, or if it is present and no version was specified
+func releaseIsUpToDate(folder string, version string) bool {
+	if _, err := os.Stat(folder); err != nil {
+		return false
+	}
+
+	if version == "" {
+		return true
+	}
+
+	deployed, err := ioutil.ReadFile(path.Join(folder, ".version"))
+	if err != nil {
+		return false
+	}
+
+	return string(deployed) == version
+}
+
+// releaseArchive returns the name of the archive of a tag in cacheFolder. As tags can be
+// moved, archives are also named after the commit of the tag, when it is known.
+func releaseArchive(cacheFolder string, version string, commit string) string {
+	name := strings.Replace(url.PathEscape(version), "@", "%40", -1)
+	if commit != "" {
+		name += "@" + commit
+	}
+
+	return path.Join(cacheFolder, name+".tar.gz")
+}
+
+// resolveCachedRelease is used offline, when tags can not be listed: it returns the archive
+// of the version fetched last, and without a version deploys the latest version cached
+func resolveCachedRelease(version *string, cacheFolder string, name string) (string, *DownloadError) {
+	archives, _ := ioutil.ReadDir(cacheFolder)
+
+	cacheFile, cachedVersion := "", ""
+	var fetchedAt time.Time
+	for _, a := range archives {
+		if !a.Mode().IsRegular() || !strings.HasSuffix(a.Name(), ".tar.gz") {
+			continue
+		}
+
+		v := strings.TrimSuffix(a.Name(), ".tar.gz")
+		if i := strings.LastIndex(v, "@"); i != -1 {
+			v = v[:i]
+		}
+		v, err := url.PathUnescape(v)
+		if err != nil || (*version != "" && v != *version) {
+			continue
+		}
+
+		if cacheFile == "" || a.ModTime().After(fetchedAt) {
+			cacheFile, cachedVersion, fetchedAt = path.Join(cacheFolder, a.Name()), v, a.ModTime()
+		}
+	}
+
+	if cacheFile == "" {
+		if *version == "" {
+			return "", notCached("any version of %s", name)
+		}
+		return "", notCached("version %s of %s", *version, name)
+	}
+
+	*version = cachedVersion
+	return cacheFile, nil
+}
+
+// downloadRelease retrieves the archive from url to cacheFile, unless it is already
+// cached, and extracts it to the folder to. An archive cached as oldCacheFile, if set,
+// by a previous version of r10k-go is reused offline, as its commit is not known.
+func (a *releaseAPI) downloadRelease(url string, cache string, cacheFile string, oldCacheFile string, to string, version string) *DownloadError {
+	l, derr := lockCacheFolder(path.Dir(cacheFile))
+	if derr != nil {
+		return derr
+	}
+	defer l.Release()
+
+	if oldCacheFile != "" {
+		migrateArchive(cache, oldCacheFile, releaseArchive(path.Dir(cacheFile), version, ""), url)
+	}
+
+	derr = fetchArchive(cache, cacheFile, url, nil, func() *DownloadError {
+		return a.downloadToCache(url, cacheFile)
+	})
+	if derr != nil {
+		return derr
+	}
+
+	// Tags can be moved, the content of the archive identifies the release
+	checksum, err := sidecar.Checksum(cacheFile)
+	if err != nil {
+		return &DownloadError{err, false}
+	}
+
+	return deploy(cache, store.Key(a.name, version, checksum), to, func(folder string) *DownloadError {
+		r, err := os.Open(cacheFile)
+		if err != nil {
+			return &DownloadError{err, false}
+		}
+		defer r.Close()
+
+		if err = archive.Extract(r, folder); err != nil {
+			return &DownloadError{err, false}
+		}
+
+		versionFile := path.Join(folder, ".version")
+		if err = ioutil.WriteFile(versionFile, []byte(version), 0644); err != nil {
+			return &DownloadError{fmt.Errorf("Failed creating file %s", versionFile), false}
+		}
+
+		return nil
+	})
+}
+
+// downloadToCache downloads the archive next to cacheFile, and only moves
+// it in place once complete
+func (a *releaseAPI) downloadToCache(url string, cacheFile string) *DownloadError {
+	if err := os.MkdirAll(path.Dir(cacheFile), 0755); err != nil {
+		return &DownloadError{err, false}
+	}
+
+	resp, err := a.get(url)
+	if err != nil {
+		return &DownloadError{fmt.Errorf("Failed retrieving %s: %v", url, err), true}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &DownloadError{fmt.Errorf("Failed retrieving %s - %s", url, resp.Status), true}
+	}
+
+	out, err := os.Create(cacheFile + ".part")
+	if err != nil {
+		return &DownloadError{err, false}
+	}
+	defer os.Remove(cacheFile + ".part")
+
+	_, err = io.Copy(out, resp.Body)
+	out.Close()
+	if err != nil {
+		return &DownloadError{fmt.Errorf("Failed retrieving %s: %v", url, err), true}
+	}
+
+	if err = os.Rename(cacheFile+".part", cacheFile); err != nil {
+		return &DownloadError{err, false}
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package puppetmodule
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/yannh/r10k-go/s3"
+)
+
+// S3Module is deployed from an archive stored in an S3-compatible object storage,
+// eg s3://bucket/vendor-foo-1.2.3.tar.gz. It is otherwise deployed like a TarballModule.
+type S3Module struct {
+	TarballModule
+}
+
+var s3Client = s3.NewClient("", "", "", "", "")
+
+// SetS3Client sets the client used to retrieve S3 modules
+func SetS3Client(c *s3.Client) {
+	s3Client = c
+}
+
+func NewS3Module(name, url, sha256, installPath string) *S3Module {
+	m := &S3Module{*NewTarballModule(name, url, sha256, installPath)}
+	m.get = s3Get
+
+	return m
+}
+
+func s3Get(url string) (io.ReadCloser, *DownloadError) {
+	bucket, key, err := s3.ParseURL(url)
+	if err != nil {
+		return nil, &DownloadError{err, false}
+	}
+
+	r, err := s3Client.Get(bucket, key)
+	if err != nil {
+		return nil, &DownloadError{fmt.Errorf("failed retrieving %s: %v", url, err), err != s3.ErrNotFound}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,45 @@
+package puppetmodule
+
+import (
+	"fmt"
+
+	"github.com/yannh/r10k-go/store"
+)
+
+// How releases are deployed from the store, or "" to extract them in every environment
+var storeMode string
+
+// SetStore enables the store, deploying releases as hardlinks or reflinks
+func SetStore(mode string) error {
+	if mode != "" && mode != store.Hardlink && mode != store.Reflink {
+		return fmt.Errorf("store should be %s or %s, got %s", store.Hardlink, store.Reflink, mode)
+	}
+
+	storeMode = mode
+
+	return nil
+}
+
+// deploy deploys a release to the folder to. If the store is enabled, the release is
+// only extracted once, to the store entry key, which identifies its content.
+func deploy(cache string, key string, to string, extract func(folder string) *DownloadError) *DownloadError {
+	if storeMode == "" {
+		return extract(to)
+	}
+
+	var derr *DownloadError
+	err := store.Materialize(cache, key, to, storeMode, func(folder string) error {
+		if derr = extract(folder); derr != nil {
+			return derr
+		}
+		return nil
+	})
+	if derr != nil {
+		return derr
+	}
+	if err != nil {
+		return &DownloadError{fmt.Errorf("failed deploying %s from the store: %v", to, err), false}
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package puppetmodule
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/yannh/r10k-go/archive"
+	"github.com/yannh/r10k-go/sidecar"
+	"github.com/yannh/r10k-go/store"
+)
+
+// TarballModule is downloaded from any HTTP(S) URL. If a SHA256 checksum is given,
+// the archive is only deployed if it matches.
+type TarballModule struct {
+	name        string
+	url         string
+	sha256      string
+	installPath string
+	get         func(url string) (io.ReadCloser, *DownloadError)
+}
+
+// The checksum of the archive a module was extracted from is recorded in this file
+const checksumFile = ".sha256"
+
+// The URL a module was downloaded from is recorded in this file
+const urlFile = ".url"
+
+func NewTarballModule(name, url, sha256, installPath string) *TarballModule {
+	return &TarballModule{
+		name:        name,
+		url:         url,
+		sha256:      strings.ToLower(sha256),
+		installPath: installPath,
+		get:         httpGet,
+	}
+}
+
+func (m *TarballModule) Name() string        { return m.name }
+func (m *TarballModule) InstallPath() string { return m.installPath }
+
+func (m *TarballModule) hash() string {
+	return cacheKey("tarball", m.url)
+}
+
+func (m *TarballModule) CacheEntry() string {
+	return m.hash()
+}
+
+// Floating returns true if no checksum is specified, as the archive at the URL can change
+func (m *TarballModule) Floating() bool {
+	return m.sha256 == ""
+}
+
+func (m *TarballModule) IsUpToDate(folder string, cache string) bool {
+	checksum, err := ioutil.ReadFile(path.Join(folder, checksumFile))
+	if err != nil {
+		return false
+	}
+
+	// The URL of the module changed in the Puppetfile
+	url, err := ioutil.ReadFile(path.Join(folder, urlFile))
+	if err != nil || strings.TrimSpace(string(url)) != m.url {
+		return false
+	}
+
+	// Module is present and no checksum specified...
+	if m.sha256 == "" {
+		return true
+	}
+
+	return strings.TrimSpace(string(checksum)) == m.sha256
+}
+
+func httpGet(url string) (io.ReadCloser, *DownloadError) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, &DownloadError{fmt.Errorf("failed retrieving %s: %v", url, err), true}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &DownloadError{fmt.Errorf("failed retrieving %s - %s", url, resp.Status), resp.StatusCode >= 500}
+	}
+
+	return resp.Body, nil
+}
+
+// downloadToCache downloads the archive next to cacheFile, and only moves
+// it in place once complete
+func (m *TarballModule) downloadToCache(cacheFile string) *DownloadError {
+	if err := os.MkdirAll(path.Dir(cacheFile), 0755); err != nil {
+		return &DownloadError{fmt.Errorf("failed creating folder %s: %v", path.Dir(cacheFile), err), false}
+	}
+
+	r, derr := m.get(m.url)
+	if derr != nil {
+		return derr
+	}
+	defer r.Close()
+
+	out, err := os.Create(cacheFile + ".part")
+	if err != nil {
+		return &DownloadError{fmt.Errorf("failed creating cache file %s: %v", cacheFile, err), false}
+	}
+	defer os.Remove(cacheFile + ".part")
+
+	_, err = io.Copy(out, r)
+	out.Close()
+	if err != nil {
+		return &DownloadError{fmt.Errorf("failed retrieving %s: %v", m.url, err), true}
+	}
+
+	if err = os.Rename(cacheFile+".part", cacheFile); err != nil {
+		return &DownloadError{err, false}
+	}
+
+	return nil
+}
+
+// matchesChecksum returns true if no checksum was specified, or if the file matches it
+func (m *TarballModule) matchesChecksum(filename string) bool {
+	checksum, err := sidecar.Checksum(filename)
+	return err == nil && (m.sha256 == "" || checksum == m.sha256)
+}
+
+func (m *TarballModule) Download(to string, cache string) *DownloadError {
+	cacheFile := path.Join(cache, m.hash(), "archive.tar.gz")
+
+	l, derr := lockCacheFolder(path.Dir(cacheFile))
+	if derr != nil {
+		return derr
+	}
+	defer l.Release()
+
+	// The archive is downloaded again if it is not in the cache, or does not match the checksum
+	derr = fetchArchive(cache, cacheFile, m.url, m.matchesChecksum, func() *DownloadError {
+		return m.downloadToCache(cacheFile)
+	})
+	if derr != nil {
+		return derr
+	}
+
+	checksum, err := sidecar.Checksum(cacheFile)
+	if err != nil {
+		return &DownloadError{err, false}
+	}
+
+	if m.sha256 != "" && checksum != m.sha256 {
+		os.Remove(cacheFile)
+		return &DownloadError{fmt.Errorf("checksum of %s is %s, expected %s", m.url, checksum, m.sha256), false}
+	}
+
+	return deploy(cache, store.Key("tarball", m.url, checksum), to, func(folder string) *DownloadError {
+		r, err := os.Open(cacheFile)
+		if err != nil {
+			return &DownloadError{err, false}
+		}
+		defer r.Close()
+
+		if err = archive.Extract(r, folder); err != nil {
+			return &DownloadError{fmt.Errorf("failed extracting %s: %v", m.url, err), false}
+		}
+
+		checksumFilename := path.Join(folder, checksumFile)
+		if err = ioutil.WriteFile(checksumFilename, []byte(checksum), 0644); err != nil {
+			return &DownloadError{fmt.Errorf("failed creating file %s", checksumFilename), false}
+		}
+
+		urlFilename := path.Join(folder, urlFile)
+		if err = ioutil.WriteFile(urlFilename, []byte(m.url), 0644); err != nil {
+			return &DownloadError{fmt.Errorf("failed creating file %s", urlFilename), false}
+		}
+
+		return nil
+	})
+}
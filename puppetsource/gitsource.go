@@ -2,20 +2,29 @@ package puppetsource
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"path"
+	"strings"
+	"sync"
 
 	"github.com/yannh/r10k-go/git"
+	"github.com/yannh/r10k-go/lock"
+	"github.com/yannh/r10k-go/sidecar"
 )
 
 type GitSource struct {
-	name     string
-	location string
-	basedir  string
-	prefix   string
-	remote   string
+	sync.Mutex // Fetching is not safe to do concurrently
+	name       string
+	location   string
+	basedir    string
+	prefix     string
+	remote     string
 }
 
+// Environments deployed as plain files record the commit they were exported from in this file
+const commitFile = ".commit"
+
 func NewGitSource(name, location, basedir, prefix, remote string) *GitSource {
 	return &GitSource{
 		name:     name,
@@ -35,15 +44,129 @@ func (s *GitSource) Fetch(cache string) error {
 	if cache == "" {
 		return fmt.Errorf("can not fetch source without cache")
 	}
+	s.Lock()
+	defer s.Unlock()
+
 	s.location = path.Join(cache, s.Name())
 
+	l, err := lock.Acquire(s.location + ".lock")
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
 	// Clone if gitSource doesnt exist, fetch otherwise
 	if err := git.RevParse(s.location); err != nil {
-		if err := git.Clone(s.Remote(), s.location); err != nil {
+		if err := git.Clone(s.Remote(), s.location, git.CloneOptions{}); err == git.ErrOffline {
+			return fmt.Errorf("source %s is not in the cache, it can not be cloned while offline", s.Name())
+		} else if err != nil {
 			log.Fatalf("%s", err)
 		}
-	} else {
-		git.Fetch(s.location)
+	} else if err := git.FetchRemote(s.location, s.Remote()); err == git.ErrOffline {
+		// Environments are deployed from the branches as last fetched
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed fetching source %s: %v", s.Name(), err)
 	}
+
+	return sidecar.Record(cache, s.Name(), s.Remote(), "")
+}
+
+// Environments returns the branches of the remote, or while offline the branches
+// of the cached repository, once fetched
+func (s *GitSource) Environments() ([]string, error) {
+	branches, err := git.ListRemoteBranches(s.Remote())
+	if err == git.ErrOffline && s.location != "" {
+		return git.Branches(s.location)
+	}
+
+	return branches, err
+}
+
+// Version returns the commit of the branch in the cached repository
+func (s *GitSource) Version(branch string) string {
+	commit, err := git.ResolveRef(s.location, git.NewRef(git.TypeBranch, branch))
+	if err != nil {
+		return ""
+	}
+
+	return commit
+}
+
+// Deploy deploys a branch of the source to the folder to, as a worktree of the cached
+// repository, or exported as plain files. The HEAD of the cached repository is never
+// changed, so several branches can be deployed concurrently. New environments are deployed
+// next to to, and only replace the deployed environment once complete.
+func (s *GitSource) Deploy(branch string, to string, moduledir string, cache string, export bool) error {
+	l, err := lock.Acquire(s.location + ".lock")
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	commit, err := git.ResolveRef(s.location, git.NewRef(git.TypeBranch, branch))
+	if err != nil {
+		return err
+	}
+	ref := git.NewRef(git.TypeRef, commit)
+
+	if export {
+		return s.export(ref, to, moduledir, cache)
+	}
+
+	// Environments deployed previously are updated in place, to keep their modules
+	if git.IsWorktreeOf(to, s.location) {
+		if err = git.Checkout(to, ref); err != nil {
+			return err
+		}
+		return git.UpdateSubmodules(to, s.Remote(), cache)
+	}
+
+	return s.deployTmp(to, moduledir, func(tmp string) error {
+		if err := git.WorktreeAdd(s.location, ref, tmp); err != nil {
+			return err
+		}
+		return git.UpdateSubmodules(tmp, s.Remote(), cache)
+	})
+}
+
+// export replaces the environment when the branch was updated
+func (s *GitSource) export(ref *git.Ref, to string, moduledir string, cache string) error {
+	if commit, err := ioutil.ReadFile(path.Join(to, commitFile)); err == nil && strings.TrimSpace(string(commit)) == ref.Ref {
+		return nil
+	}
+
+	return s.deployTmp(to, moduledir, func(tmp string) error {
+		if err := git.Export(s.location, ref, "", tmp); err != nil {
+			return err
+		}
+
+		if err := git.ExportSubmodules(s.location, ref, tmp, s.Remote(), cache); err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(path.Join(tmp, commitFile), []byte(ref.Ref), 0644)
+	})
+}
+
+// deployTmp deploys the environment to a temporary folder next to to, which then
+// replaces the deployed environment
+func (s *GitSource) deployTmp(to string, moduledir string, deploy func(tmp string) error) error {
+	// Left over by an interrupted deploy
+	tmp := siblingFolder(to, "tmp")
+	if err := git.RemoveWorktree(tmp); err != nil {
+		return err
+	}
+
+	if err := deploy(tmp); err != nil {
+		git.RemoveWorktree(tmp)
+		return err
+	}
+
+	if err := replaceEnvironment(tmp, to, moduledir); err != nil {
+		git.RemoveWorktree(tmp)
+		return err
+	}
+
 	return nil
 }
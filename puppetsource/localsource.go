@@ -0,0 +1,188 @@
+package puppetsource
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/yannh/r10k-go/git"
+)
+
+// LocalSource deploys environments from a folder of the local filesystem. Every
+// subfolder is an environment, unless a single environment is configured, in which
+// case the folder itself is deployed as that environment.
+type LocalSource struct {
+	name        string
+	location    string
+	basedir     string
+	environment string
+}
+
+// Environments deployed from a local source record the version they were copied from in this file
+const versionFile = ".version"
+
+func NewLocalSource(name, location, basedir, environment string) *LocalSource {
+	return &LocalSource{
+		name:        name,
+		location:    location,
+		basedir:     basedir,
+		environment: environment,
+	}
+}
+
+func (s *LocalSource) Name() string    { return s.name }
+func (s *LocalSource) Basedir() string { return s.basedir }
+
+// Fetch only checks that the folder exists, as local sources are not cached
+func (s *LocalSource) Fetch(cache string) error {
+	if fi, err := os.Stat(s.location); err != nil || !fi.IsDir() {
+		return fmt.Errorf("local source %s: %s is not a folder", s.name, s.location)
+	}
+
+	return nil
+}
+
+func (s *LocalSource) folder(environment string) string {
+	if s.environment != "" {
+		return s.location
+	}
+
+	return path.Join(s.location, environment)
+}
+
+func (s *LocalSource) Environments() ([]string, error) {
+	if s.environment != "" {
+		return []string{s.environment}, nil
+	}
+
+	files, err := ioutil.ReadDir(s.location)
+	if err != nil {
+		return nil, err
+	}
+
+	envs := make([]string, 0)
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			envs = append(envs, f.Name())
+		}
+	}
+
+	return envs, nil
+}
+
+// Version returns a digest of the names, sizes and modification times of the files
+// of the environment
+func (s *LocalSource) Version(environment string) string {
+	h := sha256.New()
+	root := s.folder(environment)
+
+	err := filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() && fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		rel, _ := filepath.Rel(root, file)
+		fmt.Fprintf(h, "%s %v %d %d\n", rel, fi.Mode(), fi.Size(), fi.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Deploy copies the environment to the folder to, if it changed since the last deploy.
+// Local environments are always deployed as plain files, and replace the deployed
+// environment once copied.
+func (s *LocalSource) Deploy(environment string, to string, moduledir string, cache string, export bool) error {
+	version := s.Version(environment)
+	if version == "" {
+		return fmt.Errorf("failed reading environment %s from %s", environment, s.folder(environment))
+	}
+
+	if deployed, err := ioutil.ReadFile(path.Join(to, versionFile)); err == nil && strings.TrimSpace(string(deployed)) == version {
+		return nil
+	}
+
+	// Copied next to the deployed environment, which keeps its modules
+	tmp := siblingFolder(to, "tmp")
+	if err := git.RemoveWorktree(tmp); err != nil {
+		return err
+	}
+
+	err := copyFolder(s.folder(environment), tmp)
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(tmp, versionFile), []byte(version), 0644)
+	}
+	if err == nil {
+		err = replaceEnvironment(tmp, to, moduledir)
+	}
+	if err != nil {
+		git.RemoveWorktree(tmp)
+		return fmt.Errorf("failed deploying environment %s: %v", environment, err)
+	}
+
+	return nil
+}
+
+// copyFolder copies files, folders and symlinks, skipping git metadata
+func copyFolder(from string, to string) error {
+	return filepath.Walk(from, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() && fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		rel, _ := filepath.Rel(from, file)
+		target := path.Join(to, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm()|0700)
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case fi.Mode().IsRegular():
+			return copyFile(file, target, fi.Mode().Perm())
+		}
+
+		return nil
+	})
+}
+
+func copyFile(from string, to string, mode os.FileMode) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+
+	return err
+}
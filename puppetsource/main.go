@@ -1,9 +1,89 @@
 package puppetsource
 
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/yannh/r10k-go/git"
+)
+
+// Source is implemented by GitSource and LocalSource
 type Source interface {
 	Name() string
-	Remote() string
 	Basedir() string
-	Fetch(string) error
-	Location() string
+	Fetch(cache string) error
+	Environments() ([]string, error)
+	Version(environment string) string // Empty if the version of the environment is unknown
+	Deploy(environment string, to string, moduledir string, cache string, export bool) error
+}
+
+// siblingFolder returns a hidden folder next to folder, used while replacing it
+func siblingFolder(folder string, suffix string) string {
+	return path.Join(path.Dir(folder), "."+path.Base(folder)+".r10k-"+suffix)
+}
+
+// replaceEnvironment replaces the environment in to by the one deployed to from. The
+// modules deployed to the moduledir of the environment are moved over, unless from
+// contains a module of the same name, eg committed in the control repository. If
+// anything fails, the deployed environment is kept.
+func replaceEnvironment(from string, to string, moduledir string) error {
+	if _, err := os.Lstat(to); os.IsNotExist(err) {
+		return git.RenameWorktree(from, to)
+	}
+
+	modules, _ := ioutil.ReadDir(path.Join(to, moduledir))
+	if len(modules) > 0 {
+		if err := os.MkdirAll(path.Join(from, moduledir), 0755); err != nil {
+			return err
+		}
+	}
+
+	// Modules moved over are moved back if the environment can not be replaced
+	moved := make([]string, 0)
+	restore := func() {
+		for _, name := range moved {
+			git.RenameWorktree(path.Join(from, moduledir, name), path.Join(to, moduledir, name))
+		}
+	}
+
+	for _, m := range modules {
+		target := path.Join(from, moduledir, m.Name())
+		if _, err := os.Lstat(target); err == nil {
+			continue
+		}
+
+		if err := git.RenameWorktree(path.Join(to, moduledir, m.Name()), target); err != nil {
+			restore()
+			return fmt.Errorf("failed moving module %s: %v", m.Name(), err)
+		}
+		moved = append(moved, m.Name())
+	}
+
+	old := siblingFolder(to, "old")
+	if err := git.RemoveWorktree(old); err != nil {
+		restore()
+		return err
+	}
+
+	if err := git.RenameWorktree(to, old); err != nil {
+		restore()
+		return fmt.Errorf("failed moving %s aside: %v", to, err)
+	}
+
+	if err := git.RenameWorktree(from, to); err != nil {
+		git.RenameWorktree(old, to)
+		restore()
+		return fmt.Errorf("failed moving %s to %s: %v", from, to, err)
+	}
+
+	// Worktrees of the modules are registered at the folder they were moved to
+	for _, name := range moved {
+		if err := git.RepairWorktree(path.Join(to, moduledir, name)); err != nil {
+			return err
+		}
+	}
+
+	return git.RemoveWorktree(old)
 }
@@ -0,0 +1,199 @@
+package puppetsource
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// controlRepo creates a control repository in dir, with a branch production
+func controlRepo(t *testing.T, dir string) (string, func(file string, content string) string) {
+	repo := path.Join(dir, "control")
+	os.MkdirAll(repo, 0755)
+
+	run := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("failed running git %v: %s", args, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+
+	run("init", "-q")
+	run("checkout", "-q", "-b", "production")
+
+	commit := func(file string, content string) string {
+		os.MkdirAll(path.Dir(path.Join(repo, file)), 0755)
+		ioutil.WriteFile(path.Join(repo, file), []byte(content), 0644)
+		run("add", "-A")
+		run("commit", "-q", "-m", "update "+file)
+		return run("rev-parse", "HEAD")
+	}
+
+	return repo, commit
+}
+
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed running git %v in %s: %s", args, dir, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func readFile(t *testing.T, file string) string {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed reading %s: %v", file, err)
+	}
+	return string(content)
+}
+
+func newTestSource(t *testing.T) (string, *GitSource, func(file string, content string) string) {
+	dir, err := ioutil.TempDir("", "r10k-puppetsource")
+	if err != nil {
+		t.Fatalf("failed creating temporary folder: %v", err)
+	}
+
+	repo, commit := controlRepo(t, dir)
+	commit("Puppetfile", "mod 'foo'\n")
+
+	s := NewGitSource("test", "", path.Join(dir, "environments"), "", repo)
+	if err = s.Fetch(path.Join(dir, "cache")); err != nil {
+		t.Fatalf("failed fetching source: %v", err)
+	}
+
+	return dir, s, commit
+}
+
+func TestDeployWorktree(t *testing.T) {
+	dir, s, commit := newTestSource(t)
+	defer os.RemoveAll(dir)
+
+	head := gitOutput(t, s.Location(), "rev-parse", "HEAD")
+	to := path.Join(s.Basedir(), "production")
+	cache := path.Join(dir, "cache")
+
+	if err := s.Deploy("production", to, "modules", cache, false); err != nil {
+		t.Fatalf("failed deploying environment: %v", err)
+	}
+
+	if actual := gitOutput(t, to, "rev-parse", "HEAD"); actual != s.Version("production") {
+		t.Errorf("expected the environment to be deployed at %s, got %s", s.Version("production"), actual)
+	}
+	if actual := gitOutput(t, s.Location(), "rev-parse", "HEAD"); actual != head {
+		t.Errorf("expected the HEAD of the cached repository to stay at %s, got %s", head, actual)
+	}
+
+	// Files not in the repository are kept when the environment is updated in place
+	ioutil.WriteFile(path.Join(to, "local.txt"), []byte("local"), 0644)
+
+	updated := commit("Puppetfile", "mod 'foo'\nmod 'bar'\n")
+	if err := s.Fetch(cache); err != nil {
+		t.Fatalf("failed fetching source: %v", err)
+	}
+	if err := s.Deploy("production", to, "modules", cache, false); err != nil {
+		t.Fatalf("failed updating environment: %v", err)
+	}
+
+	if actual := gitOutput(t, to, "rev-parse", "HEAD"); actual != updated {
+		t.Errorf("expected the environment to be updated to %s, got %s", updated, actual)
+	}
+	if actual := readFile(t, path.Join(to, "Puppetfile")); actual != "mod 'foo'\nmod 'bar'\n" {
+		t.Errorf("expected the Puppetfile to be updated, got %s", actual)
+	}
+	if _, err := os.Stat(path.Join(to, "local.txt")); err != nil {
+		t.Errorf("expected the environment to be updated in place: %v", err)
+	}
+	if actual := gitOutput(t, s.Location(), "rev-parse", "HEAD"); actual != head {
+		t.Errorf("expected the HEAD of the cached repository to stay at %s, got %s", head, actual)
+	}
+}
+
+func TestDeployExport(t *testing.T) {
+	dir, s, commit := newTestSource(t)
+	defer os.RemoveAll(dir)
+
+	to := path.Join(s.Basedir(), "production")
+	cache := path.Join(dir, "cache")
+
+	if err := s.Deploy("production", to, "modules", cache, true); err != nil {
+		t.Fatalf("failed deploying environment: %v", err)
+	}
+
+	if actual := readFile(t, path.Join(to, commitFile)); actual != s.Version("production") {
+		t.Errorf("expected %s to contain %s, got %s", commitFile, s.Version("production"), actual)
+	}
+	if _, err := os.Stat(path.Join(to, ".git")); err == nil {
+		t.Errorf("expected the environment to be exported without .git")
+	}
+
+	updated := commit("Puppetfile", "mod 'foo'\nmod 'bar'\n")
+	if err := s.Fetch(cache); err != nil {
+		t.Fatalf("failed fetching source: %v", err)
+	}
+	if err := s.Deploy("production", to, "modules", cache, true); err != nil {
+		t.Fatalf("failed updating environment: %v", err)
+	}
+
+	if actual := readFile(t, path.Join(to, commitFile)); actual != updated {
+		t.Errorf("expected %s to contain %s, got %s", commitFile, updated, actual)
+	}
+	if actual := readFile(t, path.Join(to, "Puppetfile")); actual != "mod 'foo'\nmod 'bar'\n" {
+		t.Errorf("expected the Puppetfile to be updated, got %s", actual)
+	}
+}
+
+func TestDeployKeepsModules(t *testing.T) {
+	dir, s, commit := newTestSource(t)
+	defer os.RemoveAll(dir)
+
+	to := path.Join(s.Basedir(), "production")
+	cache := path.Join(dir, "cache")
+
+	// Exported environments are replaced when updated, as are environments deployed
+	// as worktrees to a folder that is not a worktree yet
+	for _, export := range []bool{true, false} {
+		commit("modules/committed/init.pp", fmt.Sprintf("committed, export %v", export))
+		if err := s.Fetch(cache); err != nil {
+			t.Fatalf("failed fetching source: %v", err)
+		}
+
+		os.RemoveAll(to)
+		if err := s.Deploy("production", to, "modules", cache, true); err != nil {
+			t.Fatalf("failed deploying environment: %v", err)
+		}
+
+		// A module deployed from the Puppetfile, and a module committed in the control repository
+		os.MkdirAll(path.Join(to, "modules", "foo"), 0755)
+		ioutil.WriteFile(path.Join(to, "modules", "foo", "init.pp"), []byte("foo"), 0644)
+		ioutil.WriteFile(path.Join(to, "modules", "committed", "init.pp"), []byte("modified"), 0644)
+
+		updated := fmt.Sprintf("committed, export %v, updated", export)
+		commit("modules/committed/init.pp", updated)
+		if err := s.Fetch(cache); err != nil {
+			t.Fatalf("failed fetching source: %v", err)
+		}
+		if err := s.Deploy("production", to, "modules", cache, export); err != nil {
+			t.Fatalf("failed updating environment: %v", err)
+		}
+
+		if actual := readFile(t, path.Join(to, "modules", "foo", "init.pp")); actual != "foo" {
+			t.Errorf("export %v: expected the deployed module to be kept, got %s", export, actual)
+		}
+		if actual := readFile(t, path.Join(to, "modules", "committed", "init.pp")); actual != updated {
+			t.Errorf("export %v: expected the committed module to be updated, got %s", export, actual)
+		}
+		if _, err := os.Stat(siblingFolder(to, "old")); err == nil {
+			t.Errorf("export %v: expected the replaced environment to be removed", export)
+		}
+	}
+}
@@ -2,26 +2,85 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 
+	"github.com/yannh/r10k-go/git"
 	"github.com/yannh/r10k-go/puppetsource"
 	"gopkg.in/yaml.v2"
 )
 
 type r10kConfigSource struct {
-	Basedir string
-	Prefix  string
-	Remote  string
+	Type        string // git, the default, or local
+	Basedir     string
+	Prefix      string
+	Remote      string
+	Path        string // Folder of a local source
+	Environment string // Deploy the folder of a local source as a single environment
+}
+
+type r10kConfigGit struct {
+	Provider string // shellgit or go-git
+	Depth    int    // Shallow clone git repositories to that depth
+	Filter   string // Partial clone filter, eg blob:none
+	Deploy   string // Deploy git modules as worktrees or export them
+	Rewrites []git.URLRule
+	Mirrors  []git.URLRule // Tried in order when a repository can not be reached
+
+	VerifySignatures bool   `yaml:"verify_signatures"` // Only deploy commits signed by a key of the keyring
+	Keyring          string // Armored file of the trusted public keys
+}
+
+type r10kConfigGithub struct {
+	APIURL string `yaml:"api_url"` // For GitHub Enterprise, eg https://github.example.com/api/v3
+	Token  string // Defaults to the GITHUB_TOKEN environment variable
+}
+
+type r10kConfigGitlab struct {
+	URL   string // eg https://gitlab.example.com
+	Token string // Defaults to the GITLAB_TOKEN environment variable
+}
+
+type r10kConfigBitbucket struct {
+	APIURL string `yaml:"api_url"` // eg https://api.bitbucket.org/2.0
+	URL    string // Archives are downloaded from there, eg https://bitbucket.org
+	Token  string // Defaults to the BITBUCKET_TOKEN environment variable
+}
+
+type r10kConfigS3 struct {
+	Endpoint        string // For S3-compatible storages, eg http://localhost:9000
+	Region          string
+	AccessKeyID     string `yaml:"access_key_id"`     // Defaults to the AWS_ACCESS_KEY_ID environment variable
+	SecretAccessKey string `yaml:"secret_access_key"` // Defaults to the AWS_SECRET_ACCESS_KEY environment variable
+	Cache           string // Share downloaded archives in the bucket, eg s3://bucket/prefix
 }
 
 type r10kConfigBase struct {
-	Cachedir string
-	Sources  map[string]r10kConfigSource
+	Cachedir     string
+	CacheMaxSize string `yaml:"cache_max_size"` // Prune unused cache entries once the cache is larger, eg 10G
+	LockTimeout  string `yaml:"lock_timeout"`   // How long to wait for other deploys, eg 10m
+	Offline      bool   // Deploy from the cache only, without any network access
+	Store        string // Deploy releases from a store in the cache: hardlink or reflink
+	Git          r10kConfigGit
+	Github       r10kConfigGithub
+	Gitlab       r10kConfigGitlab
+	Bitbucket    r10kConfigBitbucket
+	S3           r10kConfigS3
+	Sources      map[string]r10kConfigSource
 }
 
 type r10kConfig struct {
-	Cachedir string
-	Sources  []puppetsource.Source
+	Cachedir     string
+	CacheMaxSize string `yaml:"cache_max_size"` // Prune unused cache entries once the cache is larger, eg 10G
+	LockTimeout  string `yaml:"lock_timeout"`   // How long to wait for other deploys, eg 10m
+	Offline      bool   // Deploy from the cache only, without any network access
+	Store        string // Deploy releases from a store in the cache: hardlink or reflink
+	Git          r10kConfigGit
+	Github       r10kConfigGithub
+	Gitlab       r10kConfigGitlab
+	Bitbucket    r10kConfigBitbucket
+	S3           r10kConfigS3
+	Sources      []puppetsource.Source
 }
 
 func parseR10kConfig(r io.Reader) (*r10kConfig, error) {
@@ -37,9 +96,25 @@ func parseR10kConfig(r io.Reader) (*r10kConfig, error) {
 	}
 
 	c.Cachedir = cb.Cachedir
+	c.CacheMaxSize = cb.CacheMaxSize
+	c.LockTimeout = cb.LockTimeout
+	c.Offline = cb.Offline
+	c.Store = cb.Store
+	c.Git = cb.Git
+	c.Github = cb.Github
+	c.Gitlab = cb.Gitlab
+	c.Bitbucket = cb.Bitbucket
+	c.S3 = cb.S3
 	c.Sources = make([]puppetsource.Source, 0)
 	for sName, s := range cb.Sources {
-		c.Sources = append(c.Sources, puppetsource.NewGitSource(sName, "", s.Basedir, s.Prefix, s.Remote))
+		switch s.Type {
+		case "", "git":
+			c.Sources = append(c.Sources, puppetsource.NewGitSource(sName, "", s.Basedir, s.Prefix, s.Remote))
+		case "local":
+			c.Sources = append(c.Sources, puppetsource.NewLocalSource(sName, s.Path, s.Basedir, s.Environment))
+		default:
+			return nil, fmt.Errorf("source %s has an unsupported type %s", sName, s.Type)
+		}
 	}
 
 	return c, nil
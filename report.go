@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/yannh/r10k-go/git"
+)
+
+// deployReport lists the modules updated during a deploy, and what changed
+type deployReport struct {
+	sync.Mutex
+	Modules []moduleReport `json:"modules"`
+}
+
+type moduleReport struct {
+	Name    string       `json:"name"`
+	Folder  string       `json:"folder"`
+	Local   bool         `json:"local,omitempty"`   // Committed in the control repository
+	Changes *git.Changes `json:"changes,omitempty"` // Not set for new modules
+}
+
+func newDeployReport() *deployReport {
+	return &deployReport{Modules: make([]moduleReport, 0)}
+}
+
+func (r *deployReport) add(name string, folder string, changes *git.Changes) {
+	r.Lock()
+	r.Modules = append(r.Modules, moduleReport{Name: name, Folder: folder, Changes: changes})
+	r.Unlock()
+}
+
+func (r *deployReport) addLocal(name string, folder string) {
+	r.Lock()
+	r.Modules = append(r.Modules, moduleReport{Name: name, Folder: folder, Local: true})
+	r.Unlock()
+}
+
+func (r *deployReport) write(filename string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append(content, '\n'), 0644)
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// summary returns a human readable summary of the changes, with the short log
+func summary(changes *git.Changes) string {
+	var s strings.Builder
+
+	fmt.Fprintf(&s, "  %s..%s: %d commits, %d files changed", shortSHA(changes.From), shortSHA(changes.To), len(changes.Commits), len(changes.Files))
+	for _, c := range changes.Commits {
+		fmt.Fprintf(&s, "\n    %s %s", shortSHA(c.SHA), c.Subject)
+	}
+
+	return s.String()
+}
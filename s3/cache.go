@@ -0,0 +1,67 @@
+package s3
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Cache stores files in a bucket, so they can be shared between servers
+type Cache struct {
+	client *Client
+	bucket string
+	prefix string
+}
+
+// NewCache returns a cache storing files under the URL, in the form s3://bucket/prefix
+func NewCache(client *Client, s3url string) (*Cache, error) {
+	bucket, prefix, err := ParseURL(s3url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cache{client: client, bucket: bucket, prefix: strings.Trim(prefix, "/")}, nil
+}
+
+func (c *Cache) key(name string) string {
+	return path.Join(c.prefix, name)
+}
+
+// Get downloads the file name to the file to, which is only created once complete
+func (c *Cache) Get(name string, to string) error {
+	r, err := c.client.Get(c.bucket, c.key(name))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err = os.MkdirAll(path.Dir(to), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(to + ".part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(to + ".part")
+
+	_, err = io.Copy(out, r)
+	out.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(to+".part", to)
+}
+
+// Put uploads the file from as name
+func (c *Cache) Put(name string, from string) error {
+	f, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.client.Put(c.bucket, c.key(name), f)
+}
@@ -0,0 +1,93 @@
+package sidecar
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// Entry describes an entry of the cache, as entries are named after a hash of their
+// source. It is stored next to the entry, in <entry>.json.
+type Entry struct {
+	Source    string            `json:"source"`              // URL of the repository or module
+	FetchedAt time.Time         `json:"fetched_at"`          // Last time the entry was downloaded or updated
+	Checksums map[string]string `json:"checksums,omitempty"` // SHA256 of the archives of the entry
+}
+
+func filename(cache string, entry string) string {
+	return path.Join(cache, entry+".json")
+}
+
+// Read returns the description of the entry of the cache
+func Read(cache string, entry string) (*Entry, error) {
+	content, err := ioutil.ReadFile(filename(cache, entry))
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Entry{}
+	if err = json.Unmarshal(content, e); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Record updates the description of the entry once it was fetched from source. If
+// file is set, it is a file of the entry that was downloaded, and its checksum is recorded.
+// Entries must be locked while recorded.
+func Record(cache string, entry string, source string, file string) error {
+	e, err := Read(cache, entry)
+	if err != nil {
+		e = &Entry{}
+	}
+
+	e.Source = source
+	e.FetchedAt = time.Now().UTC()
+
+	if file != "" {
+		checksum, err := Checksum(file)
+		if err != nil {
+			return err
+		}
+
+		if e.Checksums == nil {
+			e.Checksums = make(map[string]string)
+		}
+		e.Checksums[path.Base(file)] = checksum
+	}
+
+	content, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written next to the description, and renamed, so it is never read partially written
+	tmp := filename(cache, entry) + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename(cache, entry))
+}
+
+// Checksum returns the SHA256 of the file
+func Checksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
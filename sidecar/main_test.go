@@ -0,0 +1,61 @@
+package sidecar
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	cache, err := ioutil.TempDir("", "r10k-sidecar")
+	if err != nil {
+		t.Fatalf("failed creating temporary folder: %v", err)
+	}
+	defer os.RemoveAll(cache)
+
+	if _, err = Read(cache, "entry"); err == nil {
+		t.Errorf("expected an error reading a missing description")
+	}
+
+	archive := path.Join(cache, "entry", "1.0.0.tar.gz")
+	os.MkdirAll(path.Dir(archive), 0755)
+	if err = ioutil.WriteFile(archive, []byte("test"), 0644); err != nil {
+		t.Fatalf("failed creating %s: %v", archive, err)
+	}
+
+	if err = Record(cache, "entry", "https://example.com/first", archive); err != nil {
+		t.Fatalf("failed recording the entry: %v", err)
+	}
+
+	second := path.Join(cache, "entry", "2.0.0.tar.gz")
+	if err = ioutil.WriteFile(second, []byte("other"), 0644); err != nil {
+		t.Fatalf("failed creating %s: %v", second, err)
+	}
+
+	if err = Record(cache, "entry", "https://example.com/second", second); err != nil {
+		t.Fatalf("failed recording the entry: %v", err)
+	}
+
+	e, err := Read(cache, "entry")
+	if err != nil {
+		t.Fatalf("failed reading the entry: %v", err)
+	}
+
+	if e.Source != "https://example.com/second" {
+		t.Errorf("expected the last source to be recorded, got %s", e.Source)
+	}
+
+	if e.FetchedAt.IsZero() {
+		t.Errorf("expected the fetch time to be recorded")
+	}
+
+	// sha256 of "test"
+	if e.Checksums["1.0.0.tar.gz"] != "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" {
+		t.Errorf("expected the checksum of the first archive to be kept, got %v", e.Checksums)
+	}
+
+	if len(e.Checksums) != 2 {
+		t.Errorf("expected the checksums of both archives, got %v", e.Checksums)
+	}
+}
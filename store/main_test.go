@@ -0,0 +1,116 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func inode(t *testing.T, file string) uint64 {
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("failed stating %s: %v", file, err)
+	}
+
+	return fi.Sys().(*syscall.Stat_t).Ino
+}
+
+func TestMaterialize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-store")
+	if err != nil {
+		t.Fatalf("failed creating temporary folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := path.Join(dir, "cache")
+	key := Key("forge", "puppetlabs/stdlib", "4.25.0")
+
+	fills := 0
+	fill := func(folder string) error {
+		fills++
+		if err := os.MkdirAll(path.Join(folder, "manifests"), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(folder, "manifests", "init.pp"), []byte("class stdlib {}\n"), 0644); err != nil {
+			return err
+		}
+		return os.Symlink("manifests/init.pp", path.Join(folder, "init.pp"))
+	}
+
+	envs := []string{path.Join(dir, "production", "stdlib"), path.Join(dir, "staging", "stdlib")}
+	for _, env := range envs {
+		if err = Materialize(cache, key, env, Hardlink, fill); err != nil {
+			t.Fatalf("failed deploying to %s: %v", env, err)
+		}
+	}
+
+	if fills != 1 {
+		t.Errorf("expected the entry to be filled once, got %d", fills)
+	}
+
+	entry := path.Join(Folder(cache), key)
+	for _, env := range envs {
+		if inode(t, path.Join(env, "manifests", "init.pp")) != inode(t, path.Join(entry, "manifests", "init.pp")) {
+			t.Errorf("expected %s to be hardlinked to the store", env)
+		}
+
+		if link, err := os.Readlink(path.Join(env, "init.pp")); err != nil || link != "manifests/init.pp" {
+			t.Errorf("expected the symlink init.pp to be recreated in %s, got %s %v", env, link, err)
+		}
+	}
+
+	if refs, err := References(entry); err != nil || refs != 2 {
+		t.Errorf("expected 2 references, got %d %v", refs, err)
+	}
+
+	os.RemoveAll(envs[0])
+	if removed, err := GC(cache); err != nil || len(removed) != 0 {
+		t.Errorf("expected the entry to be kept, got %v %v", removed, err)
+	}
+
+	os.RemoveAll(envs[1])
+	if removed, err := GC(cache); err != nil || len(removed) != 1 || removed[0] != key {
+		t.Errorf("expected the entry to be removed, got %v %v", removed, err)
+	}
+
+	if _, err := os.Stat(entry); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", entry)
+	}
+}
+
+func TestMaterializeReflink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r10k-store")
+	if err != nil {
+		t.Fatalf("failed creating temporary folder: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := path.Join(dir, "cache")
+	key := Key("tarball", "checksum")
+	to := path.Join(dir, "production", "module")
+
+	err = Materialize(cache, key, to, Reflink, func(folder string) error {
+		return ioutil.WriteFile(path.Join(folder, "metadata.json"), []byte("{}"), 0640)
+	})
+	if err != nil {
+		t.Fatalf("failed deploying to %s: %v", to, err)
+	}
+
+	// Files are reflinked or copied, never shared with the store
+	file := path.Join(to, "metadata.json")
+	if inode(t, file) == inode(t, path.Join(Folder(cache), key, "metadata.json")) {
+		t.Errorf("expected %s not to be hardlinked", file)
+	}
+
+	if fi, err := os.Stat(file); err != nil {
+		t.Errorf("failed stating %s: %v", file, err)
+	} else if fi.Mode().Perm() != 0640 {
+		t.Errorf("expected %s to keep its mode, got %v", file, fi.Mode())
+	}
+
+	if refs, err := References(path.Join(Folder(cache), key)); err != nil || refs != 1 {
+		t.Errorf("expected 1 reference, got %d %v", refs, err)
+	}
+}
@@ -0,0 +1,29 @@
+package store
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink creates to as a copy-on-write clone of from, on filesystems supporting it
+func reflink(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+
+	return dst.Close()
+}
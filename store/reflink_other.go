@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package store
+
+import "errors"
+
+func reflink(from string, to string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yannh/r10k-go/lock"
+)
+
+// The store keeps a single extracted copy of every module release in the cache,
+// named after a key identifying its content. Environments get hardlinks (or reflinks)
+// to the files of an entry, and always a hardlink to its marker file: the link count
+// of the marker is the number of folders the entry is deployed to.
+
+// Identifies the entry a folder was deployed from
+const markerFile = ".r10k-store"
+
+// How files are deployed from the store
+const (
+	Hardlink = "hardlink"
+	Reflink  = "reflink" // Files are copied if the filesystem does not support reflinks
+)
+
+// Entries being created are only removed once they are older than this
+const staleAfter = time.Hour
+
+// Folder returns the folder of the store in the cache
+func Folder(cache string) string {
+	return path.Join(cache, "store")
+}
+
+// Key returns the key of the content identified by parts, eg the type of the module
+// and its version
+func Key(parts ...string) string {
+	h := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+// Materialize deploys the entry key to the folder to. If the entry is not in the
+// store yet, it is created by fill.
+func Materialize(cache string, key string, to string, mode string, fill func(folder string) error) error {
+	entry := path.Join(Folder(cache), key)
+
+	// Entries are not removed while they are deployed, see GC
+	l, err := lock.AcquireShared(Folder(cache) + ".lock")
+	if err != nil {
+		return err
+	}
+	defer l.Release()
+
+	if _, err := os.Stat(path.Join(entry, markerFile)); err != nil {
+		if err = create(entry, key, fill); err != nil {
+			return err
+		}
+	}
+
+	return linkTree(entry, to, mode)
+}
+
+// create fills a temporary folder, which is moved in place once complete
+func create(entry string, key string, fill func(folder string) error) error {
+	if err := os.MkdirAll(path.Dir(entry), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(path.Dir(entry), key+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err = fill(tmp); err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(path.Join(tmp, markerFile), []byte(key+"\n"), 0644); err != nil {
+		return err
+	}
+
+	// The entry may have been created concurrently
+	if err = os.Rename(tmp, entry); err != nil {
+		if _, serr := os.Stat(path.Join(entry, markerFile)); serr != nil {
+			return fmt.Errorf("failed adding %s to the store: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// linkTree recreates the folder from in to, linking its files
+func linkTree(from string, to string, mode string) error {
+	dirs := make(map[string]os.FileInfo)
+
+	err := filepath.Walk(from, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(from, file)
+		target := path.Join(to, rel)
+
+		switch {
+		case fi.IsDir():
+			dirs[target] = fi
+			return os.MkdirAll(target, 0755)
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		default:
+			return linkFile(file, target, mode, fi)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Set once all files are linked, as creating files changes them
+	for dir, fi := range dirs {
+		os.Chmod(dir, fi.Mode().Perm())
+		os.Chtimes(dir, fi.ModTime(), fi.ModTime())
+	}
+
+	return nil
+}
+
+// linkFile links from to to, and falls back to copying it, eg when the environments
+// are on another filesystem than the cache. The marker is always hardlinked, as it
+// counts the references to the entry.
+func linkFile(from string, to string, mode string, fi os.FileInfo) error {
+	if mode != Reflink || path.Base(from) == markerFile {
+		if err := os.Link(from, to); err == nil {
+			return nil
+		}
+	} else if err := reflink(from, to); err == nil {
+		os.Chmod(to, fi.Mode().Perm())
+		return os.Chtimes(to, fi.ModTime(), fi.ModTime())
+	}
+
+	return copyFile(from, to, fi)
+}
+
+func copyFile(from string, to string, fi os.FileInfo) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(to, fi.ModTime(), fi.ModTime())
+}
+
+// References returns the number of folders the entry is deployed to
+func References(entry string) (int, error) {
+	fi, err := os.Stat(path.Join(entry, markerFile))
+	if err != nil {
+		return 0, err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("failed counting references to %s", entry)
+	}
+
+	return int(st.Nlink) - 1, nil
+}
+
+// GC removes the entries that are not deployed anywhere anymore, and returns their keys.
+// Hardlinked files stay valid even if their entry is removed. Nothing is removed while
+// other processes are deploying from the store.
+func GC(cache string) ([]string, error) {
+	removed := make([]string, 0)
+
+	files, err := ioutil.ReadDir(Folder(cache))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return removed, nil
+		}
+		return removed, err
+	}
+
+	l, err := lock.TryAcquire(Folder(cache) + ".lock")
+	if err != nil {
+		return removed, nil
+	}
+	defer l.Release()
+
+	for _, f := range files {
+		entry := path.Join(Folder(cache), f.Name())
+
+		// Left over by an interrupted deploy
+		if strings.Contains(f.Name(), ".tmp-") {
+			if time.Since(f.ModTime()) > staleAfter {
+				os.RemoveAll(entry)
+			}
+			continue
+		}
+
+		if refs, err := References(entry); err != nil || refs > 0 {
+			continue
+		}
+
+		if err = os.RemoveAll(entry); err != nil {
+			return removed, err
+		}
+		removed = append(removed, f.Name())
+	}
+
+	return removed, nil
+}
@@ -2,7 +2,7 @@
 
 setup() {
   # We clean modules and cache between each test
-  rm -rf modules modules-test .cache123 test-fixtures/modules environments-production test-fixtures/test_install_path
+  rm -rf modules modules-test .cache123 test-fixtures/modules environments-production environments-local test-fixtures/test_install_path
   ./test-fixtures/create-git-fixtures.sh
 }
 
@@ -108,3 +108,12 @@ setup() {
   [ -d .cache123 ]
   [ "$status" -eq 0 ]
 }
+
+@test "should install an environment from a local source" {
+  run r10k-go deploy environment local_production
+  [ "$status" -eq 0 ]
+  [ -f environments-local/local_production/Puppetfile ]
+  [ -d environments-local/local_production/modules/testmodule ]
+  run git --git-dir environments-local/local_production/modules/testmodule/.git describe --tags
+  [[ "$output" = *"v1"* ]]
+}